@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/internal/service"
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// batchItem 是批量转换中的一个源文件
+type batchItem struct {
+	src     string // 源文件路径
+	rel     string // 相对输入目录的路径
+	outBase string // 输出路径（不含扩展名），目录结构与输入一致
+	skipped string // 已存在的输出文件，非空时跳过
+	result  types.ConvertResult
+}
+
+// runConvert 离线批量转换目录，不启动 HTTP 服务，返回进程退出码：
+// 0 全部成功，1 存在失败的文件，2 参数或配置错误
+func runConvert(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	configPath := flags.String("config", "", "配置文件路径")
+	ffmpegBin := flags.String("ffmpeg", "ffmpeg", "ffmpeg可执行文件路径")
+	inDir := flags.String("in", "", "输入目录")
+	outDir := flags.String("out", "", "输出目录，保持与输入相同的目录结构")
+	recursive := flags.Bool("r", false, "递归处理子目录")
+	format := flags.String("format", "", "输出格式或模式（auto/passthrough），默认取配置 default_format")
+	strip := flags.Bool("strip-metadata", false, "清除标签与封面，默认取配置 strip_metadata")
+	force := flags.Bool("force", false, "输出文件已存在时仍重新转换")
+	workers := flags.Int("workers", 0, "并发转换的文件数，默认取配置 workers")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "用法: server convert -in <输入目录> -out <输出目录> [-r] [选项]")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *inDir == "" || *outDir == "" {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath, ":8080", *ffmpegBin)
+	if err != nil {
+		log.Printf("加载配置失败: %v", err)
+		return 2
+	}
+	// 进度与结果由标准库 log 输出，zap 只记录转换过程中的警告与错误（如 ffmpeg 的诊断日志）
+	level := cfg.Log.Level
+	if lvl, err := zapcore.ParseLevel(level); err == nil && lvl < zapcore.WarnLevel {
+		level = "warn"
+	}
+	logger, err := logging.New(cfg.Log.Format, level)
+	if err != nil {
+		log.Printf("初始化日志失败: %v", err)
+		return 2
+	}
+	zap.ReplaceGlobals(logger)
+	defer logger.Sync()
+
+	opts := service.Options{Format: cfg.DefaultFormat, StripMetadata: cfg.StripMetadata}
+	if *format != "" {
+		opts.Format = *format
+	}
+	choice, ok := service.ValidChoice(opts.Format)
+	if !ok {
+		log.Printf("不支持的输出格式 %q，可选: %s", opts.Format, strings.Join(service.Choices(), ", "))
+		return 2
+	}
+	opts.Format = choice
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "strip-metadata" {
+			opts.StripMetadata = *strip
+		}
+	})
+	if *workers > 0 {
+		cfg.Workers = *workers
+	}
+
+	conv, err := service.NewConverter(cfg)
+	if err != nil {
+		log.Printf("初始化转换器失败: %v", err)
+		return 2
+	}
+
+	items, err := scanBatch(*inDir, *outDir, *recursive, opts.Format, *force)
+	if err != nil {
+		log.Printf("扫描输入目录失败: %v", err)
+		return 2
+	}
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		log.Printf("创建输出目录失败: %v", err)
+		return 2
+	}
+
+	// 中间文件放在输出目录下，完成后在同一文件系统内重命名到目标位置
+	workDir, err := os.MkdirTemp(*outDir, ".kgm2flac_*")
+	if err != nil {
+		log.Printf("创建临时工作目录失败: %v", err)
+		return 2
+	}
+	defer os.RemoveAll(workDir)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	start := time.Now()
+	runBatch(ctx, conv, cfg, items, workDir, opts)
+
+	if printSummary(items, time.Since(start)) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// scanBatch 收集输入目录下支持的加密文件，并标记输出已存在的文件。
+// 同一目录下主干相同的文件（如 a.kgm 与 a.ncm）按扫描顺序为输出加上 " (2)" 等序号
+func scanBatch(inDir, outDir string, recursive bool, choice string, force bool) ([]*batchItem, error) {
+	absOut, _ := filepath.Abs(outDir)
+	names := utils.NewNameSet()
+
+	var items []*batchItem
+	err := filepath.WalkDir(inDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == inDir {
+				return nil
+			}
+			// 输出目录位于输入目录内时不再扫描
+			if abs, _ := filepath.Abs(path); !recursive || abs == absOut {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !service.IsSupportedExt(filepath.Ext(path)) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(inDir, path)
+		if err != nil {
+			return err
+		}
+		item := &batchItem{
+			src:     path,
+			rel:     rel,
+			outBase: filepath.Join(outDir, names.Claim(utils.ReplaceExt(rel, ""))),
+		}
+		if !force {
+			item.skipped = service.ExistingOutput(item.outBase, choice)
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+// runBatch 以 cfg.Workers 的并发度转换所有未跳过的文件
+func runBatch(ctx context.Context, conv *service.Converter, cfg *config.Config, items []*batchItem, workDir string, opts service.Options) {
+	var pending []*batchItem
+	for _, item := range items {
+		if item.skipped == "" {
+			pending = append(pending, item)
+		}
+	}
+
+	queue := make(chan *batchItem)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done int
+	)
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				item.result = convertItem(ctx, conv, cfg, item, workDir, opts)
+
+				mu.Lock()
+				done++
+				if item.result.Err != nil {
+					log.Printf("[%d/%d] 失败 %s: %v", done, len(pending), item.rel, item.result.Err)
+				} else {
+					log.Printf("[%d/%d] 完成 %s -> %s", done, len(pending), item.rel, item.result.OutPath)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, item := range pending {
+		queue <- item
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// convertItem 在 FileTimeout 限制内转换单个文件，输出写入镜像的目录结构
+func convertItem(ctx context.Context, conv *service.Converter, cfg *config.Config, item *batchItem, workDir string, opts service.Options) types.ConvertResult {
+	if cfg.FileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.FileTimeout)
+		defer cancel()
+	}
+	res, tagErr := conv.ConvertFile(ctx, item.src, item.outBase, workDir, opts)
+	if tagErr != nil {
+		log.Printf("[WARN] 写入标签失败 %s: %v", item.rel, tagErr)
+	}
+	res.OrigName = item.rel
+	return res
+}
+
+// printSummary 打印每个文件的结果表格，返回失败的文件数
+func printSummary(items []*batchItem, took time.Duration) int {
+	var success, skipped, failed int
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "状态\t文件\t加密\t源格式\t处理\t耗时\t输出/错误")
+	for _, item := range items {
+		r := item.result
+		switch {
+		case item.skipped != "":
+			skipped++
+			fmt.Fprintf(tw, "跳过\t%s\t-\t-\t-\t-\t%s\n", item.rel, item.skipped)
+		case r.Err != nil:
+			failed++
+			fmt.Fprintf(tw, "失败\t%s\t%s\t%s\t%s\t%s\t[%s] %v\n", item.rel, dash(r.Cipher), dash(r.SourceFormat), dash(r.Action), r.Duration.Round(time.Millisecond), types.ErrorCode(r.Err), r.Err)
+		default:
+			success++
+			fmt.Fprintf(tw, "成功\t%s\t%s\t%s\t%s\t%s\t%s\n", item.rel, r.Cipher, r.SourceFormat, r.Action, r.Duration.Round(time.Millisecond), r.OutPath)
+		}
+	}
+	_ = tw.Flush()
+	fmt.Printf("\n共 %d 个文件：成功 %d，跳过 %d，失败 %d，耗时 %s\n", len(items), success, skipped, failed, took.Round(time.Millisecond))
+	return failed
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
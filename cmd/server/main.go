@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"kgm2flac-backend/internal/config"
 	"kgm2flac-backend/internal/handler"
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/pkg/types"
 	"log"
+	"os"
 	"runtime"
+
+	"go.uber.org/zap"
 )
 
 // 编译时通过 -ldflags 注入
@@ -18,6 +23,16 @@ var (
 )
 
 func main() {
+	// 子命令：离线批量转换、监视目录
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			os.Exit(runConvert(os.Args[2:]))
+		case "watch":
+			os.Exit(runWatch(os.Args[2:]))
+		}
+	}
+
 	// 命令行参数解析
 	configPath := flag.String("config", "", "配置文件路径")
 	showHelp := flag.Bool("help", false, "显示帮助信息")
@@ -48,16 +63,41 @@ func main() {
 	if err != nil {
 		log.Fatalf("加载配置失败: %v", err)
 	}
+	logger, err := setupLogger(cfg)
+	if err != nil {
+		log.Fatalf("初始化日志失败: %v", err)
+	}
+	defer logger.Sync()
 
 	// 启动服务器
-	if err := handler.StartServer(cfg); err != nil {
-		log.Fatalf("服务器启动失败: %v", err)
+	build := types.BuildInfo{
+		Version:    version,
+		BuildDate:  buildDate,
+		CommitHash: commitHash,
+		AppEnv:     appEnv,
+		GoVersion:  runtime.Version(),
+	}
+	if err := handler.StartServer(cfg, build); err != nil {
+		logger.Fatal("服务器启动失败", zap.Error(err))
+	}
+}
+
+// setupLogger 按配置创建全局 logger，标准库 log 的输出也重定向到它
+func setupLogger(cfg *config.Config) (*zap.Logger, error) {
+	logger, err := logging.New(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return nil, err
 	}
+	zap.ReplaceGlobals(logger)
+	zap.RedirectStdLog(logger)
+	return logger, nil
 }
 
 func printHelp() {
 	fmt.Println("KGM to FLAC 转换服务")
 	fmt.Println("用法: server [选项]")
+	fmt.Println("      server convert -in <输入目录> -out <输出目录> [-r] [选项]")
+	fmt.Println("      server watch -config config.yaml")
 	fmt.Println()
 	fmt.Println("选项:")
 	flag.PrintDefaults()
@@ -65,6 +105,8 @@ func printHelp() {
 	fmt.Println("示例:")
 	fmt.Println("  server --config config.yaml --addr :8080")
 	fmt.Println("  server --ffmpeg /usr/local/bin/ffmpeg")
+	fmt.Println("  server convert -in ./backup -out ./flac -r -format auto")
+	fmt.Println("  server watch -config config.yaml")
 	fmt.Println("  server --version")
 	fmt.Println("  server --env")
 }
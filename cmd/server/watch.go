@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/internal/service"
+	"kgm2flac-backend/internal/watch"
+
+	"go.uber.org/zap"
+)
+
+// runWatch 按配置中的 watch 段监视目录并自动转换新文件，返回进程退出码
+func runWatch(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	configPath := flags.String("config", "", "配置文件路径（需包含 watch 段）")
+	ffmpegBin := flags.String("ffmpeg", "ffmpeg", "ffmpeg可执行文件路径")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "用法: server watch -config config.yaml [选项]")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath, ":8080", *ffmpegBin)
+	if err != nil {
+		log.Printf("加载配置失败: %v", err)
+		return 2
+	}
+	logger, err := setupLogger(cfg)
+	if err != nil {
+		log.Printf("初始化日志失败: %v", err)
+		return 2
+	}
+	defer logger.Sync()
+
+	conv, err := service.NewConverter(cfg)
+	if err != nil {
+		logger.Error("初始化转换器失败", zap.Error(err))
+		return 2
+	}
+	w, err := watch.New(cfg, conv)
+	if err != nil {
+		logger.Error("监视配置无效", zap.Error(err))
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := w.Run(ctx); err != nil {
+		logger.Error("监视目录失败", zap.Error(err))
+		return 1
+	}
+	return 0
+}
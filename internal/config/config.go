@@ -1,16 +1,83 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"os"
+	"runtime"
+	"time"
 )
 
 type Config struct {
-	Addr            string `yaml:"addr" json:"addr"`
-	FFmpegBin       string `yaml:"ffmpeg_bin" json:"ffmpeg_bin"`
-	MaxFileSize     int64  `yaml:"max_file_size" json:"max_file_size"`
-	MaxFiles        int    `yaml:"max_files" json:"max_files"`
-	ParseFormMemory int64  `yaml:"parse_form_memory" json:"parse_form_memory"`
+	Addr             string              `yaml:"addr" json:"addr"`
+	FFmpegBin        string              `yaml:"ffmpeg_bin" json:"ffmpeg_bin"`
+	MaxFileSize      int64               `yaml:"max_file_size" json:"max_file_size"`
+	MaxFiles         int                 `yaml:"max_files" json:"max_files"`
+	JobTTL           time.Duration       `yaml:"job_ttl" json:"job_ttl"`                     // 异步任务完成后保留时长
+	Workers          int                 `yaml:"workers" json:"workers"`                     // 单个批次并发处理的文件数
+	MaxFFmpeg        int                 `yaml:"max_ffmpeg" json:"max_ffmpeg"`               // 全局同时运行的 ffmpeg 进程上限
+	FileTimeout      time.Duration       `yaml:"file_timeout" json:"file_timeout"`           // 单文件处理超时，0 表示不限制
+	DefaultFormat    string              `yaml:"default_format" json:"default_format"`       // 未指定 format 时的输出格式
+	Encoders         map[string][]string `yaml:"encoders" json:"encoders"`                   // 按输出格式覆盖 ffmpeg 编码参数
+	StripMetadata    bool                `yaml:"strip_metadata" json:"strip_metadata"`       // 默认清除标签与封面，可被请求参数覆盖
+	FilenamePatterns []string            `yaml:"filename_patterns" json:"filename_patterns"` // 从文件名解析标签的正则，命名分组 artist/title/album/version
+	CacheDir         string              `yaml:"cache_dir" json:"cache_dir"`                 // 转换结果缓存目录，为空时不缓存
+	CacheMaxSize     int64               `yaml:"cache_max_size" json:"cache_max_size"`       // 缓存总大小上限，超出时淘汰最久未使用的结果
+	MinFreeSpace     int64               `yaml:"min_free_space" json:"min_free_space"`       // 临时目录剩余空间低于此值时 /readyz 返回未就绪，0 表示不检查
+	UploadDir        string              `yaml:"upload_dir" json:"upload_dir"`               // 可续传上传（tus）的保存目录，为空时不启用
+	UploadTTL        time.Duration       `yaml:"upload_ttl" json:"upload_ttl"`               // 可续传上传在最后一次写入后保留的时长
+	ShutdownTimeout  time.Duration       `yaml:"shutdown_timeout" json:"shutdown_timeout"`   // 收到退出信号后等待进行中转换完成的最长时间，超时后终止 ffmpeg
+	Watch            WatchConfig         `yaml:"watch" json:"watch"`                         // 监视目录模式（server watch）
+	Log              LogConfig           `yaml:"log" json:"log"`                             // 日志输出
+	Auth             AuthConfig          `yaml:"auth" json:"-"`                              // API 密钥，未配置时不校验
+	TrustedProxies   []string            `yaml:"trusted_proxies" json:"trusted_proxies"`     // 可信代理的 IP 或 CIDR，只有来自这些地址的请求才采信 X-Forwarded-For
+	RateLimit        RateLimitConfig     `yaml:"rate_limit" json:"rate_limit"`               // 按客户端 IP 限流
+}
+
+// RateLimitConfig 是按客户端 IP 的令牌桶限流配置，桶容量为一分钟的量，0 表示不限制
+type RateLimitConfig struct {
+	RequestsPerMinute int   `yaml:"requests_per_minute" json:"requests_per_minute"`
+	FilesPerMinute    int   `yaml:"files_per_minute" json:"files_per_minute"`
+	BytesPerMinute    int64 `yaml:"bytes_per_minute" json:"bytes_per_minute"`
+}
+
+// AuthConfig 是 /api/* 的 API 密钥配置
+type AuthConfig struct {
+	Keys    []APIKey `yaml:"keys"`
+	KeyFile string   `yaml:"key_file"` // 额外的密钥文件，内容为与 keys 格式相同的 YAML 列表
+}
+
+// APIKey 是一个调用方的密钥与配额，配额为 0 表示不限制
+type APIKey struct {
+	Name          string `yaml:"name"`
+	Key           string `yaml:"key"`
+	FilesPerDay   int64  `yaml:"files_per_day"`  // 每天可上传的文件数
+	BytesPerDay   int64  `yaml:"bytes_per_day"`  // 每天可上传的字节数
+	MaxConcurrent int    `yaml:"max_concurrent"` // 同时进行的转换请求与异步任务数
+}
+
+// LogConfig 是日志配置
+type LogConfig struct {
+	Format string `yaml:"format" json:"format"` // json 或 console
+	Level  string `yaml:"level" json:"level"`   // debug/info/warn/error
+}
+
+// 转换成功后对源文件的处理方式
+const (
+	WatchKeep   = "keep"
+	WatchMove   = "move"
+	WatchDelete = "delete"
+)
+
+// WatchConfig 是监视目录模式的配置
+type WatchConfig struct {
+	Dirs          []string      `yaml:"dirs" json:"dirs"`                     // 监视的目录
+	OutputDir     string        `yaml:"output_dir" json:"output_dir"`         // 输出目录，保持与监视目录相同的结构
+	Interval      time.Duration `yaml:"interval" json:"interval"`             // 轮询间隔，文件大小与修改时间在两次轮询间不变才视为写入完成
+	Recursive     bool          `yaml:"recursive" json:"recursive"`           // 是否监视子目录
+	OnSuccess     string        `yaml:"on_success" json:"on_success"`         // 转换成功后源文件的处理：keep/move/delete
+	DoneDir       string        `yaml:"done_dir" json:"done_dir"`             // on_success 为 move 时源文件的目标目录
+	QuarantineDir string        `yaml:"quarantine_dir" json:"quarantine_dir"` // 转换失败的源文件移入此目录，并附带错误说明
 }
 
 // 默认配置
@@ -20,7 +87,31 @@ func DefaultConfig() *Config {
 		FFmpegBin:       "ffmpeg",
 		MaxFileSize:     1 << 30, // 1GB
 		MaxFiles:        50,
-		ParseFormMemory: 32 << 20, // 32MB
+		JobTTL:          time.Hour,
+		Workers:         runtime.GOMAXPROCS(0),
+		MaxFFmpeg:       runtime.GOMAXPROCS(0),
+		FileTimeout:     10 * time.Minute,
+		DefaultFormat:   "flac",
+		CacheMaxSize:    2 << 30, // 2GB
+		MinFreeSpace:    1 << 30, // 1GB
+		UploadTTL:       24 * time.Hour,
+		ShutdownTimeout: 30 * time.Second,
+		FilenamePatterns: []string{
+			// 歌手、歌手2 - 歌名 (Live)
+			`^(?P<artist>.+?)\s+-\s+(?P<title>.+?)(?:\s*[(（\[【](?P<version>[^()（）\[\]【】]+)[)）\]】])?$`,
+			// 歌名 (Live)
+			`^(?P<title>.+?)(?:\s*[(（\[【](?P<version>[^()（）\[\]【】]+)[)）\]】])?$`,
+		},
+		Watch: WatchConfig{
+			Interval:  10 * time.Second,
+			Recursive: true,
+			OnSuccess: WatchKeep,
+		},
+		TrustedProxies: []string{"127.0.0.0/8", "::1/128"},
+		Log: LogConfig{
+			Format: "json",
+			Level:  "info",
+		},
 	}
 }
 
@@ -40,6 +131,37 @@ func LoadConfig(configPath, addr, ffmpegBin string) (*Config, error) {
 		}
 	}
 
+	if cfg.Auth.KeyFile != "" {
+		data, err := os.ReadFile(cfg.Auth.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取密钥文件失败: %w", err)
+		}
+		var keys []APIKey
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("解析密钥文件失败: %w", err)
+		}
+		cfg.Auth.Keys = append(cfg.Auth.Keys, keys...)
+	}
+	// 任务与可续传上传按密钥名记录所有者（上传重启后仍需识别），因此名称也必须唯一
+	seen := make(map[string]bool, len(cfg.Auth.Keys))
+	names := make(map[string]bool, len(cfg.Auth.Keys))
+	for i, k := range cfg.Auth.Keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("第 %d 个 API 密钥的 name 为空", i+1)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("API 密钥名 %q 重复", k.Name)
+		}
+		names[k.Name] = true
+		if k.Key == "" {
+			return nil, fmt.Errorf("API 密钥 %q 的 key 为空", k.Name)
+		}
+		if seen[k.Key] {
+			return nil, fmt.Errorf("API 密钥 %q 与其他密钥重复", k.Name)
+		}
+		seen[k.Key] = true
+	}
+
 	// 命令行参数优先于配置文件
 	if addr != ":8080" {
 		cfg.Addr = addr
@@ -48,6 +170,14 @@ func LoadConfig(configPath, addr, ffmpegBin string) (*Config, error) {
 		cfg.FFmpegBin = ffmpegBin
 	}
 
+	// 并发数未配置或非法时回退到 CPU 数
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.MaxFFmpeg <= 0 {
+		cfg.MaxFFmpeg = runtime.GOMAXPROCS(0)
+	}
+
 	return cfg, nil
 }
 
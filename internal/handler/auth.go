@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errUnauthorized  = types.NewError(types.CodeUnauthorized, errors.New("缺少或无效的 API 密钥"))
+	errQuotaExceeded = errors.New("超出今日配额")
+)
+
+// keyAuth 校验 /api/* 请求的 API 密钥并统计每个密钥的用量。
+// 用量只保存在内存中，按本地日期每天清零，进程重启后重新计算
+type keyAuth struct {
+	keys map[string]*keyUsage // 以密钥为键
+}
+
+// keyUsage 是一个密钥当天的用量
+type keyUsage struct {
+	cfg config.APIKey
+
+	mu     sync.Mutex
+	day    string
+	files  int64
+	bytes  int64
+	active int
+}
+
+type leaseKey struct{}
+
+// keyLease 是一次请求对密钥的占用。上传请求占用一个并发名额，
+// 异步任务通过 detach 接管名额，直到任务结束才释放
+type keyLease struct {
+	usage    *keyUsage
+	slot     bool
+	detached bool
+	once     sync.Once
+}
+
+func newKeyAuth(keys []config.APIKey) *keyAuth {
+	if len(keys) == 0 {
+		return nil
+	}
+	a := &keyAuth{keys: make(map[string]*keyUsage, len(keys))}
+	for _, k := range keys {
+		a.keys[k.Key] = &keyUsage{cfg: k}
+	}
+	return a
+}
+
+// require 校验密钥，POST 请求额外占用并发名额，响应中附带配额头。未配置密钥时不校验
+func (a *keyAuth) require(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := a.keys[apiKeyFromRequest(r)]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kgm2flac"`)
+			writeError(w, r, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+
+		lease := &keyLease{usage: u}
+		if r.Method == http.MethodPost {
+			if err := u.acquire(); err != nil {
+				u.writeQuotaHeaders(w)
+				w.Header().Set("Retry-After", strconv.Itoa(u.retryAfter(err)))
+				writeError(w, r, http.StatusTooManyRequests, err)
+				return
+			}
+			lease.slot = true
+		}
+		defer func() {
+			if !lease.detached {
+				lease.release()
+			}
+		}()
+
+		ctx := context.WithValue(r.Context(), leaseKey{}, lease)
+		ctx = logging.WithContext(ctx, logging.FromContext(ctx).With(zap.String("api_key", u.cfg.Name)))
+		next.ServeHTTP(&quotaWriter{ResponseWriter: w, u: u}, r.WithContext(ctx))
+	})
+}
+
+// quotaWriter 在写出响应头时才填入配额头，剩余量包含本次请求已计入的文件数与字节数
+type quotaWriter struct {
+	http.ResponseWriter
+	u     *keyUsage
+	wrote bool
+}
+
+func (w *quotaWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.u.writeQuotaHeaders(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap 供 http.ResponseController 访问底层的 Flush 等能力
+func (w *quotaWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// apiKeyFromRequest 从 X-API-Key 或 Authorization: Bearer 读取密钥
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func leaseFromContext(ctx context.Context) *keyLease {
+	l, _ := ctx.Value(leaseKey{}).(*keyLease)
+	return l
+}
+
+// name 返回密钥名，未启用认证时为空
+func (l *keyLease) name() string {
+	if l == nil {
+		return ""
+	}
+	return l.usage.cfg.Name
+}
+
+// detach 将并发名额交给调用方，由其在任务结束时调用 release
+func (l *keyLease) detach() *keyLease {
+	if l == nil {
+		return nil
+	}
+	l.detached = true
+	return l
+}
+
+func (l *keyLease) release() {
+	if l == nil || !l.slot {
+		return
+	}
+	l.once.Do(func() {
+		l.usage.mu.Lock()
+		l.usage.active--
+		l.usage.mu.Unlock()
+	})
+}
+
+// addFile 计入一个上传文件，超出每日文件数或字节数时返回错误
+func (l *keyLease) addFile() error {
+	if l == nil {
+		return nil
+	}
+	u := l.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	if err := u.exhausted(); err != nil {
+		return err
+	}
+	u.files++
+	return nil
+}
+
+// reader 返回统计上传字节数的 Reader，超出每日字节数时读取失败
+func (l *keyLease) reader(r io.Reader) io.Reader {
+	if l == nil || l.usage.cfg.BytesPerDay <= 0 {
+		return r
+	}
+	return &quotaReader{r: r, u: l.usage}
+}
+
+type quotaReader struct {
+	r   io.Reader
+	u   *keyUsage
+	err error // 超出配额时的错误
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.u.mu.Lock()
+	q.u.rollover()
+	q.u.bytes += int64(n)
+	over := q.u.bytes > q.u.cfg.BytesPerDay
+	q.u.mu.Unlock()
+	if over {
+		q.err = types.NewError(types.CodeQuotaExceeded, fmt.Errorf("%w：每日上传上限 %d 字节", errQuotaExceeded, q.u.cfg.BytesPerDay))
+		return n, q.err
+	}
+	return n, err
+}
+
+// quotaError 返回读取 r 时遇到的配额超限错误。该错误虽已记录在单个文件的结果中，
+// 但之后的文件同样无法上传，调用方据此中止整个请求
+func quotaError(r io.Reader) error {
+	if q, ok := r.(*quotaReader); ok {
+		return q.err
+	}
+	return nil
+}
+
+// acquire 占用一个并发名额，当天配额已用完时同样拒绝
+func (u *keyUsage) acquire() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	if err := u.exhausted(); err != nil {
+		return err
+	}
+	if u.cfg.MaxConcurrent > 0 && u.active >= u.cfg.MaxConcurrent {
+		return types.NewError(types.CodeQuotaExceeded, fmt.Errorf("同时进行的任务数已达上限 %d", u.cfg.MaxConcurrent))
+	}
+	u.active++
+	return nil
+}
+
+// exhausted 在当天文件数或字节数用完时返回错误，调用方需持有锁
+func (u *keyUsage) exhausted() error {
+	if u.cfg.FilesPerDay > 0 && u.files >= u.cfg.FilesPerDay {
+		return types.NewError(types.CodeQuotaExceeded, fmt.Errorf("%w：每日文件数上限 %d", errQuotaExceeded, u.cfg.FilesPerDay))
+	}
+	if u.cfg.BytesPerDay > 0 && u.bytes >= u.cfg.BytesPerDay {
+		return types.NewError(types.CodeQuotaExceeded, fmt.Errorf("%w：每日上传上限 %d 字节", errQuotaExceeded, u.cfg.BytesPerDay))
+	}
+	return nil
+}
+
+// rollover 日期变化时清零当天用量，调用方需持有锁
+func (u *keyUsage) rollover() {
+	if day := time.Now().Format(time.DateOnly); day != u.day {
+		u.day = day
+		u.files = 0
+		u.bytes = 0
+	}
+}
+
+// writeQuotaHeaders 写入已配置配额的上限与剩余量，以及配额重置时间
+func (u *keyUsage) writeQuotaHeaders(w http.ResponseWriter) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	h := w.Header()
+	if u.cfg.FilesPerDay > 0 {
+		h.Set("X-Quota-Files-Limit", strconv.FormatInt(u.cfg.FilesPerDay, 10))
+		h.Set("X-Quota-Files-Remaining", strconv.FormatInt(max(u.cfg.FilesPerDay-u.files, 0), 10))
+	}
+	if u.cfg.BytesPerDay > 0 {
+		h.Set("X-Quota-Bytes-Limit", strconv.FormatInt(u.cfg.BytesPerDay, 10))
+		h.Set("X-Quota-Bytes-Remaining", strconv.FormatInt(max(u.cfg.BytesPerDay-u.bytes, 0), 10))
+	}
+	if u.cfg.MaxConcurrent > 0 {
+		h.Set("X-Quota-Concurrent-Limit", strconv.Itoa(u.cfg.MaxConcurrent))
+	}
+	h.Set("X-Quota-Reset", strconv.FormatInt(nextMidnight().Unix(), 10))
+}
+
+// retryAfter 返回 Retry-After 秒数：每日配额用完时等到次日，并发已满时稍后重试
+func (u *keyUsage) retryAfter(err error) int {
+	if errors.Is(err, errQuotaExceeded) {
+		return int(time.Until(nextMidnight()).Seconds()) + 1
+	}
+	return 5
+}
+
+func nextMidnight() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+}
@@ -2,22 +2,32 @@ package handler
 
 import (
 	"archive/zip"
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"html/template"
 	"io"
-	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/internal/logging"
 	"kgm2flac-backend/internal/service"
 	"kgm2flac-backend/internal/utils"
 	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
 )
 
 const page = `<!doctype html>
@@ -146,6 +156,21 @@ const page = `<!doctype html>
             box-shadow: none;
         }
         
+        .format-select {
+            margin-top: 20px;
+            display: flex;
+            align-items: center;
+            gap: 10px;
+        }
+        
+        .format-select select {
+            flex: 1;
+            padding: 8px;
+            border: 1px solid #ddd;
+            border-radius: 6px;
+            font-size: 1em;
+        }
+        
         .file-list {
             margin-top: 20px;
             max-height: 200px;
@@ -174,6 +199,36 @@ const page = `<!doctype html>
             margin-left: 10px;
         }
         
+        .file-progress {
+            width: 100%;
+            height: 4px;
+            margin-top: 6px;
+            background: #e0e0e0;
+            border-radius: 2px;
+            overflow: hidden;
+        }
+        
+        .file-progress-fill {
+            height: 100%;
+            width: 0%;
+            background: #4facfe;
+            transition: width 0.3s ease;
+        }
+        
+        .file-item.failed {
+            border-left-color: #ff4757;
+        }
+        
+        .file-item.done {
+            border-left-color: #00b09b;
+        }
+        
+        .file-state {
+            color: #666;
+            font-size: 0.85em;
+            margin-top: 4px;
+        }
+        
         .remove-btn {
             background: #ff4757;
             color: white;
@@ -273,17 +328,30 @@ const page = `<!doctype html>
                 <div class="upload-area" id="dropZone">
                     <div class="upload-icon">📁</div>
                     <h3>选择或拖放文件到此区域</h3>
-                    <p>支持 .kgm, .kgma, .vpr 格式文件</p>
+                    <p>支持 {{.ExtList}} 格式文件</p>
                     <p>最多可上传 {{.MaxFiles}} 个文件，单个文件不超过 {{.MaxFileSizeGB}} GB</p>
                     
                     <input type="file" id="fileInput" name="files" multiple 
-                           accept=".kgm,.kgma,.vpr" class="file-input" />
+                           accept="{{.AcceptExts}}" class="file-input" />
                     <button type="button" class="browse-btn" onclick="document.getElementById('fileInput').click()">
                         选择文件
                     </button>
                 </div>
                 
                 <div id="fileList" class="file-list"></div>
+
+                <div class="format-select">
+                    <label for="formatSelect">输出格式</label>
+                    <select id="formatSelect" name="format">
+                        {{range .Formats}}<option value="{{.}}"{{if eq . $.DefaultFormat}} selected{{end}}>{{.}}</option>{{end}}
+                    </select>
+                </div>
+                {{if .AuthRequired}}
+                <div class="format-select">
+                    <label for="apiKeyInput">API 密钥</label>
+                    <input type="password" id="apiKeyInput" autocomplete="off" />
+                </div>
+                {{end}}
                 
                 <div class="progress-container" style="display: none;" id="progressContainer">
                     <div class="progress-bar">
@@ -325,6 +393,12 @@ const page = `<!doctype html>
         const maxFiles = {{.MaxFiles}};
         const maxFileSize = {{.MaxFileSize}};
         const maxFileSizeMB = {{.MaxFileSizeMB}};
+        const allowedExts = {{.Exts}};
+        const formatSelect = document.getElementById('formatSelect');
+        const savedApiKey = document.getElementById('apiKeyInput');
+        if (savedApiKey) {
+            savedApiKey.value = localStorage.getItem('kgm2flac_api_key') || '';
+        }
         
         const dropZone = document.getElementById('dropZone');
         const fileInput = document.getElementById('fileInput');
@@ -376,9 +450,15 @@ const page = `<!doctype html>
         });
         
         function handleFiles(files) {
+            // 选择新文件时清除上一次的转换结果
+            if (fileRows.length > 0) {
+                fileRows = [];
+                fileList.innerHTML = '';
+                progressContainer.style.display = 'none';
+            }
             const newFiles = Array.from(files).filter(file => {
                 const ext = file.name.toLowerCase().split('.').pop();
-                return ['kgm', 'kgma', 'vpr'].includes(ext);
+                return allowedExts.includes(ext);
             });
             
             if (selectedFiles.length + newFiles.length > maxFiles) {
@@ -431,6 +511,210 @@ const page = `<!doctype html>
             return parseFloat((bytes / Math.pow(k, i)).toFixed(2)) + ' ' + sizes[i];
         }
         
+        // 从 Content-Disposition 中取出服务端给出的文件名
+        function parseFilename(disposition) {
+            if (!disposition) return '';
+            const ext = disposition.match(/filename\*=UTF-8''([^;]+)/i);
+            if (ext) {
+                try {
+                    return decodeURIComponent(ext[1]);
+                } catch (e) {}
+            }
+            const m = disposition.match(/filename="((?:[^"\\]|\\.)*)"/);
+            return m ? m[1].replace(/\\(.)/g, '$1') : '';
+        }
+        
+        // 每个文件的处理阶段在总进度中的占比，转码进度按比例映射到 30%-100%
+        const stageProgress = {received: 10, decrypt_start: 15, decrypt_done: 30};
+        let fileRows = [];
+        
+        function requestHeaders() {
+            const headers = {'Accept': 'application/json'};
+            const apiKeyInput = document.getElementById('apiKeyInput');
+            if (apiKeyInput) {
+                headers['X-API-Key'] = apiKeyInput.value;
+                localStorage.setItem('kgm2flac_api_key', apiKeyInput.value);
+            }
+            return headers;
+        }
+        
+        function errorMessage(status, body) {
+            if (status === 401) return 'API 密钥无效';
+            if (status === 429) return '超出配额，请稍后重试';
+            try {
+                return JSON.parse(body).error.message;
+            } catch (e) {
+                return '请求失败（' + status + '）';
+            }
+        }
+        
+        // 为每个文件显示状态与进度条
+        function renderProgressList() {
+            fileList.innerHTML = '';
+            fileRows = selectedFiles.map(file => {
+                const item = document.createElement('div');
+                item.className = 'file-item';
+                const info = document.createElement('div');
+                info.className = 'file-name';
+                const name = document.createElement('div');
+                name.textContent = file.name;
+                const state = document.createElement('div');
+                state.className = 'file-state';
+                state.textContent = '等待上传';
+                const bar = document.createElement('div');
+                bar.className = 'file-progress';
+                const fill = document.createElement('div');
+                fill.className = 'file-progress-fill';
+                bar.appendChild(fill);
+                info.appendChild(name);
+                info.appendChild(state);
+                info.appendChild(bar);
+                item.appendChild(info);
+                fileList.appendChild(item);
+                return {item: item, state: state, fill: fill, percent: 0};
+            });
+        }
+        
+        function setFileProgress(index, percent, text) {
+            const row = fileRows[index];
+            if (!row) return;
+            row.percent = Math.max(row.percent, percent);
+            row.fill.style.width = row.percent + '%';
+            if (text) row.state.textContent = text;
+            const total = fileRows.reduce((sum, r) => sum + r.percent, 0) / fileRows.length;
+            progressFill.style.width = total + '%';
+        }
+        
+        function handleEvent(type, ev) {
+            switch (type) {
+            case 'received':
+                setFileProgress(ev.index, stageProgress.received, '已上传，等待处理');
+                break;
+            case 'decrypt_start':
+                setFileProgress(ev.index, stageProgress.decrypt_start, '解密中...');
+                break;
+            case 'decrypt_done':
+                setFileProgress(ev.index, stageProgress.decrypt_done, '已解密（' + ev.cipher + '）');
+                break;
+            case 'format':
+                if (ev.action === 'transcode') {
+                    setFileProgress(ev.index, stageProgress.decrypt_done, ev.source_format + ' → ' + ev.format + ' 转码中...');
+                } else {
+                    setFileProgress(ev.index, 90, ev.source_format + ' 直接输出');
+                }
+                break;
+            case 'progress':
+                setFileProgress(ev.index, stageProgress.decrypt_done + ev.percent * 0.7, '转码中 ' + Math.floor(ev.percent) + '%');
+                break;
+            case 'result':
+                if (ev.result.state === 'done') {
+                    fileRows[ev.index].item.classList.add('done');
+                    setFileProgress(ev.index, 100, '完成：' + ev.result.output + (ev.result.cached ? '（缓存）' : ''));
+                } else {
+                    fileRows[ev.index].item.classList.add('failed');
+                    setFileProgress(ev.index, 100, '失败：' + ev.result.error);
+                }
+                break;
+            }
+        }
+        
+        // 读取任务的 SSE 进度流；EventSource 无法携带 API 密钥请求头，因此用 fetch 解析
+        function streamEvents(jobId, headers) {
+            return fetch('/api/jobs/' + jobId + '/events', {headers: headers}).then(response => {
+                if (!response.ok) {
+                    return response.text().then(body => {
+                        throw new Error(errorMessage(response.status, body));
+                    });
+                }
+                const reader = response.body.getReader();
+                const decoder = new TextDecoder();
+                let buffer = '';
+                let finalStatus = null;
+                function pump() {
+                    return reader.read().then(chunk => {
+                        if (chunk.done) return finalStatus;
+                        buffer += decoder.decode(chunk.value, {stream: true});
+                        let idx;
+                        while ((idx = buffer.indexOf('\n\n')) >= 0) {
+                            const block = buffer.slice(0, idx);
+                            buffer = buffer.slice(idx + 2);
+                            let type = 'message';
+                            let data = '';
+                            block.split('\n').forEach(line => {
+                                if (line.startsWith('event: ')) type = line.slice(7);
+                                else if (line.startsWith('data: ')) data += line.slice(6);
+                            });
+                            if (!data) continue;
+                            const ev = JSON.parse(data);
+                            if (type === 'done') {
+                                finalStatus = ev;
+                            } else {
+                                handleEvent(type, ev);
+                            }
+                        }
+                        return pump();
+                    });
+                }
+                return pump();
+            }).then(status => {
+                // 连接中断时查询一次任务状态
+                if (status) return status;
+                return fetch('/api/jobs/' + jobId, {headers: headers}).then(r => r.json()).then(st => {
+                    if (st.state !== 'done') throw new Error('进度连接中断，请稍后重试');
+                    return st;
+                });
+            });
+        }
+        
+        function downloadResult(url, headers) {
+            let downloadName = '';
+            return fetch(url, {headers: headers})
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(body => {
+                            throw new Error(errorMessage(response.status, body));
+                        });
+                    }
+                    downloadName = parseFilename(response.headers.get('Content-Disposition'));
+                    return response.blob();
+                })
+                .then(blob => {
+                    // 创建下载链接
+                    const url = window.URL.createObjectURL(blob);
+                    const a = document.createElement('a');
+                    a.style.display = 'none';
+                    a.href = url;
+                    a.download = downloadName || 'kgm2flac_result.zip';
+                    document.body.appendChild(a);
+                    a.click();
+                    window.URL.revokeObjectURL(url);
+                });
+        }
+        
+        // 上传文件创建异步任务，XHR 可以报告上传进度
+        function createJob(formData, headers) {
+            return new Promise((resolve, reject) => {
+                const xhr = new XMLHttpRequest();
+                xhr.open('POST', '/api/jobs');
+                Object.keys(headers).forEach(k => xhr.setRequestHeader(k, headers[k]));
+                xhr.upload.addEventListener('progress', e => {
+                    if (!e.lengthComputable) return;
+                    const percent = Math.floor(e.loaded * 100 / e.total);
+                    progressFill.style.width = percent + '%';
+                    statusText.textContent = '上传中 ' + percent + '%';
+                });
+                xhr.addEventListener('load', () => {
+                    if (xhr.status === 202) {
+                        resolve(JSON.parse(xhr.responseText));
+                    } else {
+                        reject(new Error(errorMessage(xhr.status, xhr.responseText)));
+                    }
+                });
+                xhr.addEventListener('error', () => reject(new Error('网络错误')));
+                xhr.send(formData);
+            });
+        }
+        
         // 表单提交处理
         document.getElementById('uploadForm').addEventListener('submit', function(e) {
             e.preventDefault();
@@ -440,76 +724,109 @@ const page = `<!doctype html>
                 return;
             }
             
+            // 选项字段需位于文件之前，服务端边接收边处理
             const formData = new FormData();
+            formData.append('format', formatSelect.value);
             selectedFiles.forEach(file => {
                 formData.append('files', file);
             });
             
             // 显示进度条
             progressContainer.style.display = 'block';
+            progressFill.style.width = '0%';
             submitBtn.disabled = true;
             statusText.textContent = '上传中...';
+            renderProgressList();
             
-            fetch('/api/convert', {
-                method: 'POST',
-                body: formData
-            })
-            .then(response => {
-                if (!response.ok) {
-                    throw new Error('上传失败');
-                }
-                return response.blob();
-            })
-            .then(blob => {
-                // 创建下载链接
-                const url = window.URL.createObjectURL(blob);
-                const a = document.createElement('a');
-                a.style.display = 'none';
-                a.href = url;
-                
-                if (selectedFiles.length === 1) {
-                    a.download = selectedFiles[0].name.replace(/\.[^/.]+$/, "") + '.flac';
-                } else {
-                    a.download = 'kgm2flac_result.zip';
-                }
-                
-                document.body.appendChild(a);
-                a.click();
-                window.URL.revokeObjectURL(url);
-                
-                statusText.textContent = '转换完成！';
-                progressFill.style.width = '100%';
-                
-                // 重置表单
-                setTimeout(() => {
+            const headers = requestHeaders();
+            createJob(formData, headers)
+                .then(job => {
+                    statusText.textContent = '转换中...';
+                    progressFill.style.width = '0%';
+                    return streamEvents(job.id, headers);
+                })
+                .then(st => {
+                    progressFill.style.width = '100%';
+                    if (!st.download_url) {
+                        throw new Error('所有文件处理失败');
+                    }
+                    statusText.textContent = '转换完成（成功 ' + st.success + '，失败 ' + st.failed + '），正在下载...';
+                    return downloadResult(st.download_url, headers).then(() => {
+                        statusText.textContent = '转换完成（成功 ' + st.success + '，失败 ' + st.failed + '）';
+                    });
+                })
+                .then(() => {
+                    // 重置表单，保留每个文件的结果直到下次选择
                     selectedFiles = [];
-                    fileList.innerHTML = '';
                     updateSubmitButton();
-                    progressContainer.style.display = 'none';
-                    progressFill.style.width = '0%';
-                }, 2000);
-            })
-            .catch(error => {
-                console.error('Error:', error);
-                statusText.textContent = '上传失败: ' + error.message;
-                progressFill.style.width = '0%';
-                submitBtn.disabled = false;
-            });
+                })
+                .catch(error => {
+                    console.error('Error:', error);
+                    statusText.textContent = '转换失败: ' + error.message;
+                    submitBtn.disabled = selectedFiles.length === 0;
+                });
         });
     </script>
 </body>
 </html>`
 
 type ConvertHandler struct {
-	cfg            *config.Config
-	decryptService *service.DecryptService
+	cfg       *config.Config
+	converter *service.Converter
+	cache     *service.ResultCache // 未配置 cache_dir 时为 nil
+	uploads   *service.UploadStore // 未配置 upload_dir 时为 nil
+	jobs      *jobStore
+	auth      *keyAuth     // 未配置 API 密钥时为 nil
+	limiter   *rateLimiter // 未配置限流时为 nil
+	proxies   *trustedProxies
+	metrics   *metrics
+	build     types.BuildInfo
+
+	// ctx 是后台任务的上下文，关闭超时后取消以终止剩余转换
+	ctx      context.Context
+	cancel   context.CancelFunc
+	running  sync.WaitGroup // 进行中的后台任务
+	draining atomic.Bool    // 收到退出信号后不再接收新上传
+
+	streamsDone chan struct{} // 关闭时通知 SSE 连接断开
+	tempDir     string        // 本实例的临时父目录，退出时删除
 }
 
-func NewConvertHandler(cfg *config.Config) *ConvertHandler {
-	return &ConvertHandler{
-		cfg:            cfg,
-		decryptService: service.NewDecryptService(),
+func NewConvertHandler(cfg *config.Config, build types.BuildInfo) (*ConvertHandler, error) {
+	converter, err := service.NewConverter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ConvertHandler{
+		cfg:       cfg,
+		converter: converter,
+		jobs:      newJobStore(cfg.JobTTL),
+		auth:      newKeyAuth(cfg.Auth.Keys),
+		limiter:   newRateLimiter(cfg.RateLimit),
+		build:     build,
+
+		streamsDone: make(chan struct{}),
 	}
+	if h.proxies, err = newTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	if cfg.CacheDir != "" {
+		if h.cache, err = service.NewResultCache(cfg.CacheDir, cfg.CacheMaxSize); err != nil {
+			return nil, fmt.Errorf("打开结果缓存失败: %w", err)
+		}
+	}
+	if cfg.UploadDir != "" {
+		if h.uploads, err = service.NewUploadStore(cfg.UploadDir, cfg.UploadTTL); err != nil {
+			return nil, fmt.Errorf("打开上传目录失败: %w", err)
+		}
+	}
+	if h.tempDir, err = newInstanceTempDir(); err != nil {
+		return nil, fmt.Errorf("无法创建临时目录: %w", err)
+	}
+	h.metrics = newMetrics(converter, h.cache)
+	return h, nil
 }
 
 func (h *ConvertHandler) HandleRoot(w http.ResponseWriter, r *http.Request) {
@@ -518,199 +835,457 @@ func (h *ConvertHandler) HandleRoot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 支持的扩展名
+	exts := service.SupportedExts()
+	bareExts := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		bareExts = append(bareExts, strings.TrimPrefix(ext, "."))
+	}
+
 	// 准备模板数据
 	templateData := map[string]interface{}{
 		"MaxFiles":      h.cfg.MaxFiles,
 		"MaxFileSize":   h.cfg.MaxFileSize,
 		"MaxFileSizeGB": h.cfg.MaxFileSize >> 30,
 		"MaxFileSizeMB": h.cfg.MaxFileSize >> 20,
-		"Version":       "1.0.0",
+		"Version":       h.build.Version,
+		"Exts":          bareExts,
+		"ExtList":       strings.Join(exts, ", "),
+		"AcceptExts":    strings.Join(exts, ","),
+		"Formats":       service.Choices(),
+		"DefaultFormat": h.cfg.DefaultFormat,
+		"AuthRequired":  h.auth != nil,
 	}
 
 	t := template.Must(template.New("index").Parse(page))
 	if err := t.Execute(w, templateData); err != nil {
 		http.Error(w, "模板渲染失败", http.StatusInternalServerError)
-		log.Printf("[ERR] template execute failed: %v", err)
+		logging.FromContext(r.Context()).Error("template execute failed", zap.Error(err))
 	}
 }
 
 func (h *ConvertHandler) HandleConvert(w http.ResponseWriter, r *http.Request) {
 	startReq := time.Now()
-	clientIP := getClientIP(r)
+	logger := logging.FromContext(r.Context())
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if h.rejectIfDraining(w, r) {
+		return
+	}
 
-	// 限制整个请求体最大值
-	limit := int64(h.cfg.MaxFiles)*h.cfg.MaxFileSize + (10 << 20) // +10MiB
-	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	opts, err := h.resolveOptions(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
 
-	// ParseMultipartForm
-	if err := r.ParseMultipartForm(h.cfg.ParseFormMemory); err != nil {
-		http.Error(w, "表单解析失败: "+err.Error(), http.StatusBadRequest)
-		log.Printf("[ERR] parse multipart form failed ip=%s err=%v", clientIP, err)
+	// 创建临时工作目录
+	workDir, err := os.MkdirTemp(h.tempDir, "convert_*")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("无法创建临时工作目录: %w", err))
+		logger.Error("mkdir temp failed", zap.Error(err))
 		return
 	}
+	// JSON 模式下工作目录交给任务保存，供之后下载
+	keepWorkDir := false
 	defer func() {
-		// 清理 ParseMultipartForm 创建的临时文件
-		if r.MultipartForm != nil {
-			_ = r.MultipartForm.RemoveAll()
+		if !keepWorkDir {
+			_ = os.RemoveAll(workDir)
 		}
 	}()
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "未选择文件（字段名为 files）", http.StatusBadRequest)
-		return
-	}
-	if len(files) > h.cfg.MaxFiles {
-		http.Error(w, fmt.Sprintf("最多上传 %d 个文件", h.cfg.MaxFiles), http.StatusBadRequest)
-		return
-	}
+	logger.Info("upload start")
 
-	log.Printf("[UPLOAD START] ip=%s files=%d", clientIP, len(files))
+	// 边接收边处理：每个文件在读取上传流的同时解密（启用缓存时先落盘并查询缓存），解密完成后交给 worker 转码，
+	// 此时继续读取下一个文件。结果按上传顺序保存，done[i] 在第 i 个文件处理结束时关闭
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []types.ConvertResult
+		done    []chan struct{}
+	)
+	workers := utils.NewSemaphore(h.cfg.Workers)
+	names := utils.NewNameSet()
+	ctx := r.Context()
+
+	_, err = h.readUploads(w, r, &opts, func(name string, body io.Reader) error {
+		start := time.Now()
+		logger.Info("file received", zap.String("name", name))
+
+		mu.Lock()
+		i := len(results)
+		results = append(results, types.ConvertResult{OrigName: name, Format: opts.Format, State: types.StateQueued})
+		done = append(done, make(chan struct{}))
+		t := &fileTask{result: results[i], outBase: filepath.Join(workDir, names.Claim(outputStem(name))), m: h.metrics}
+		mu.Unlock()
+		store := func(res types.ConvertResult) {
+			mu.Lock()
+			results[i] = res
+			close(done[i])
+			mu.Unlock()
+		}
+
+		fctx, cancel := h.fileContext(ctx)
+		dr, cleanup, ok := h.decryptStream(fctx, t, body, opts, workDir, start)
+		if !ok {
+			cancel()
+			store(t.result)
+			return nil
+		}
+
+		if err := workers.Acquire(ctx); err != nil {
+			cleanup()
+			cancel()
+			store(t.fail(fileError(types.CodeCanceled, fmt.Errorf("处理已取消: %w", err))))
+			return err
+		}
+		wg.Add(1)
+		go func(opts convertOptions) {
+			defer wg.Done()
+			defer workers.Release()
+			defer cancel()
+			defer cleanup()
+			store(h.finishFile(fctx, t, dr, opts, start))
+		}(opts)
+		return nil
+	})
 
-	// 创建临时工作目录
-	workDir, err := os.MkdirTemp("", "kgm2flac_*")
 	if err != nil {
-		http.Error(w, "无法创建临时工作目录: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("[ERR] mkdir temp failed ip=%s err=%v", clientIP, err)
+		wg.Wait()
+		writeUploadError(w, r, err)
+		logger.Warn("read upload failed", zap.Error(err))
 		return
 	}
-	defer func() {
-		_ = os.RemoveAll(workDir)
-	}()
 
-	// 处理每个文件
-	results := make([]types.ConvertResult, 0, len(files))
-	for _, fh := range files {
-		result := h.processSingleFile(fh, workDir, clientIP, r.Context())
-		results = append(results, result)
+	// JSON 模式：等待全部完成后返回每个文件的状态，结果保存为已完成的任务，通过 download_url 下载
+	if wantsJSON(r) {
+		wg.Wait()
+		keepWorkDir = true
+		h.respondJSONResults(w, r, results, workDir)
+		logger.Info("upload end",
+			zap.Int("total_files", len(results)),
+			zap.String("format", opts.Format),
+			zap.String("mode", "json"),
+			zap.Duration("took", time.Since(startReq)))
+		return
 	}
 
-	// 统计成功数量
+	// 按上传顺序等待各文件完成：出现第二个成功的文件时开始以 zip 流式响应，
+	// 之后每完成一个文件就写入一个；最终只有一个成功的文件时直接返回该文件
+	var (
+		zs    *zipStream
+		first *types.ConvertResult
+	)
 	successCount := 0
-	for _, r := range results {
-		if r.Err == nil {
-			successCount++
+	for i := range done {
+		<-done[i]
+		mu.Lock()
+		rr := results[i]
+		mu.Unlock()
+		if rr.Err != nil {
+			continue
 		}
+		successCount++
+		if zs == nil {
+			if first == nil {
+				first = &rr
+				continue
+			}
+			logger.Info("stream zip")
+			zs = newZipStream(w, logger)
+			zs.add(*first)
+		}
+		zs.add(rr)
 	}
+	wg.Wait()
 
 	// 处理响应
-	if successCount == 0 {
-		http.Error(w, "所有文件处理失败", http.StatusBadRequest)
+	switch {
+	case zs != nil:
+		zs.close(results)
+	case first != nil:
+		h.serveSingleFile(w, r, results)
+	default:
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeAllFailed, errors.New("所有文件处理失败")))
 		return
 	}
 
-	if successCount == 1 {
-		h.serveSingleFile(w, r, results, clientIP)
-	} else {
-		h.serveZipFile(w, r, results, workDir, clientIP)
-	}
-
-	totalDur := time.Since(startReq)
-	log.Printf("[UPLOAD END] ip=%s total_files=%d success=%d took=%s", clientIP, len(files), successCount, totalDur)
+	logger.Info("upload end",
+		zap.Int("total_files", len(results)),
+		zap.Int("success", successCount),
+		zap.String("format", opts.Format),
+		zap.Duration("took", time.Since(startReq)))
 
 	// 记录每个文件的详情
 	for _, rr := range results {
 		if rr.Err != nil {
-			log.Printf("[FILE RESULT] ip=%s name=%s size=%d err=%v", clientIP, rr.OrigName, rr.Size, rr.Err)
+			logger.Info("file result",
+				zap.String("name", rr.OrigName),
+				zap.Int64("size", rr.Size),
+				zap.String("code", types.ErrorCode(rr.Err)),
+				zap.Error(rr.Err))
 		} else {
-			log.Printf("[FILE RESULT] ip=%s name=%s size=%d out=%s dur=%s", clientIP, rr.OrigName, rr.Size, rr.OutPath, rr.Duration)
+			logger.Info("file result",
+				zap.String("name", rr.OrigName),
+				zap.Int64("size", rr.Size),
+				zap.String("cipher", rr.Cipher),
+				zap.String("source", rr.SourceFormat),
+				zap.String("action", rr.Action),
+				zap.String("out", rr.OutPath),
+				zap.Duration("dur", rr.Duration))
 		}
 	}
 }
 
-func (h *ConvertHandler) processSingleFile(fh *multipart.FileHeader, workDir, clientIP string, ctx interface{}) types.ConvertResult {
-	start := time.Now()
-	result := types.ConvertResult{
-		OrigName: fh.Filename,
-		Size:     fh.Size,
+// fileTask 跟踪单个文件的处理结果，状态变化时通知 onState（可为 nil），
+// 异步任务中的文件还会将进度发布到 events
+type fileTask struct {
+	result   types.ConvertResult
+	outBase  string // 输出路径（不含扩展名），在同一批次内唯一
+	onState  func(state string)
+	index    int       // 文件在任务中的序号
+	events   *eventLog // 同步转换时为 nil
+	cacheKey string    // 结果缓存键，未启用缓存时为空
+	m        *metrics
+}
+
+func (t *fileTask) setState(state string) {
+	t.result.State = state
+	if t.onState != nil {
+		t.onState(state)
 	}
+}
 
-	log.Printf("[FILE] ip=%s filename=%s size=%d", clientIP, fh.Filename, fh.Size)
+func (t *fileTask) fail(err error) types.ConvertResult {
+	stage := t.result.State
+	t.result.Err = err
+	t.setState(types.StateFailed)
+	t.m.fileFailed(stage, err)
+	return t.result
+}
+
+// done 标记处理成功
+func (t *fileTask) done(start time.Time) types.ConvertResult {
+	t.result.Duration = time.Since(start)
+	t.setState(types.StateDone)
+	t.m.fileConverted(t.result)
+	return t.result
+}
 
-	// 检查文件大小
-	if fh.Size > h.cfg.MaxFileSize {
-		result.Err = fmt.Errorf("文件 %s 超过单文件限制 (%d bytes)", fh.Filename, h.cfg.MaxFileSize)
-		log.Printf("[ERR] %v", result.Err)
-		return result
+// fileContext 为单个文件派生带 FileTimeout 的 context
+func (h *ConvertHandler) fileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.cfg.FileTimeout > 0 {
+		return context.WithTimeout(ctx, h.cfg.FileTimeout)
 	}
+	return context.WithCancel(ctx)
+}
 
-	// 打开上传的文件
-	f, err := fh.Open()
-	if err != nil {
-		result.Err = fmt.Errorf("打开上传文件失败: %w", err)
-		log.Printf("[ERR] open uploaded file failed ip=%s name=%s err=%v", clientIP, fh.Filename, err)
-		return result
+// decryptStream 解密上传的文件，失败时已将错误记录到 t。
+// 启用缓存时先将上传内容落盘并计算哈希，命中缓存时不再解密；否则边接收边解密。
+// 返回 false 时 t 已是最终结果（失败或命中缓存）
+func (h *ConvertHandler) decryptStream(ctx context.Context, t *fileTask, body io.Reader, opts convertOptions, workDir string, start time.Time) (*service.DecryptResult, func(), bool) {
+	logger := logging.FromContext(ctx)
+	name := t.result.OrigName
+	src := &sizeLimitReader{r: body, max: h.cfg.MaxFileSize}
+
+	var inPath string
+	if h.cache != nil {
+		hasher := sha256.New()
+		var err error
+		inPath, err = h.persistUpload(io.TeeReader(src, hasher), name, workDir)
+		t.result.Size = src.n
+		h.metrics.inputBytes.Observe(float64(src.n))
+		if err != nil {
+			logger.Warn("save upload failed", zap.String("name", name), zap.Error(err))
+			t.fail(fileError(types.CodeUploadFailed, fmt.Errorf("保存上传文件失败: %w", err)))
+			return nil, nil, false
+		}
+		t.cacheKey = h.converter.CacheKey(hasher.Sum(nil), name, service.Options(opts))
+		if h.fromCache(ctx, t, start) {
+			_ = os.Remove(inPath)
+			return nil, nil, false
+		}
 	}
-	defer f.Close()
 
-	// 保存上传文件到临时位置
-	inPath, cleanupIn, err := h.persistUpload(f, fh)
+	t.setState(types.StateDecrypting)
+	t.emit(types.EventDecryptStart, types.FileEvent{})
+	decryptStart := time.Now()
+	var (
+		dr      *service.DecryptResult
+		cleanup func()
+		err     error
+	)
+	if inPath != "" {
+		dr, cleanup, err = h.converter.Decrypt.DecryptFile(ctx, inPath, name, workDir)
+		_ = os.Remove(inPath)
+	} else {
+		dr, cleanup, err = h.converter.Decrypt.DecryptStream(ctx, src, name, workDir)
+		t.result.Size = src.n
+		h.metrics.inputBytes.Observe(float64(src.n))
+	}
+	h.metrics.decryptSeconds.Observe(time.Since(decryptStart).Seconds())
 	if err != nil {
-		result.Err = fmt.Errorf("保存上传文件失败: %w", err)
-		log.Printf("[ERR] persist upload failed ip=%s name=%s err=%v", clientIP, fh.Filename, err)
-		return result
+		logger.Warn("decrypt failed", zap.String("name", name), zap.Error(err))
+		t.fail(fileError(types.CodeDecryptFailed, fmt.Errorf("解密失败: %w", err)))
+		return nil, nil, false
+	}
+	t.result.Cipher = dr.Cipher
+	t.emit(types.EventDecryptDone, types.FileEvent{Cipher: dr.Cipher})
+	logger.Info("decrypted", zap.String("name", name), zap.String("cipher", dr.Cipher), zap.Int64("size", t.result.Size))
+	return dr, cleanup, true
+}
+
+// convertFile 对已落盘的加密文件执行解密、嗅探、转码，结果记录在 t 中。
+// ctx 取消或超过 FileTimeout 时中止处理
+func (h *ConvertHandler) convertFile(ctx context.Context, t *fileTask, inPath string, opts convertOptions, workDir string, start time.Time) types.ConvertResult {
+	ctx, cancel := h.fileContext(ctx)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+
+	t.m = h.metrics
+	t.result.Format = opts.Format
+	name := t.result.OrigName
+
+	if err := ctx.Err(); err != nil {
+		logger.Warn("aborted before start", zap.String("name", name), zap.Error(err))
+		return t.fail(fileError(types.CodeCanceled, fmt.Errorf("处理已取消: %w", err)))
+	}
+
+	// 落盘的文件可以先计算哈希，命中缓存时连解密也可以省去
+	if h.cache != nil {
+		if sum, err := fileSHA256(inPath); err == nil {
+			t.cacheKey = h.converter.CacheKey(sum, name, service.Options(opts))
+			if h.fromCache(ctx, t, start) {
+				return t.result
+			}
+		}
 	}
-	defer cleanupIn()
 
 	// 解密文件
-	outRaw, cleanupRaw, err := h.decryptService.DecryptKgmFile(inPath)
+	t.setState(types.StateDecrypting)
+	t.emit(types.EventDecryptStart, types.FileEvent{})
+	decryptStart := time.Now()
+	dr, cleanupRaw, err := h.converter.Decrypt.DecryptFile(ctx, inPath, name, workDir)
+	h.metrics.decryptSeconds.Observe(time.Since(decryptStart).Seconds())
 	if err != nil {
-		result.Err = fmt.Errorf("解密失败: %w", err)
-		log.Printf("[ERR] decrypt failed ip=%s name=%s err=%v", clientIP, fh.Filename, err)
-		return result
+		logger.Warn("decrypt failed", zap.String("name", name), zap.Error(err))
+		return t.fail(fileError(types.CodeDecryptFailed, fmt.Errorf("解密失败: %w", err)))
 	}
 	defer cleanupRaw()
+	t.result.Cipher = dr.Cipher
+	t.emit(types.EventDecryptDone, types.FileEvent{Cipher: dr.Cipher})
+	logger.Info("decrypted", zap.String("name", name), zap.String("cipher", dr.Cipher))
 
-	// 嗅探音频格式
-	rawExt, err := h.sniffAudioExt(outRaw)
-	if err != nil {
-		result.Err = fmt.Errorf("识别音频格式失败: %w", err)
-		log.Printf("[ERR] sniff audio ext failed ip=%s name=%s err=%v", clientIP, fh.Filename, err)
-		return result
-	}
-
-	// 处理输出文件
-	finalPath := filepath.Join(workDir, utils.ReplaceExt(fh.Filename, ".flac"))
-	if rawExt == ".flac" {
-		// 如果已经是flac，直接重命名
-		if err := os.Rename(outRaw, finalPath); err != nil {
-			if err := h.copyFile(outRaw, finalPath); err != nil {
-				result.Err = fmt.Errorf("移动FLAC文件失败: %w", err)
-				log.Printf("[ERR] move/copy flac failed ip=%s name=%s err=%v", clientIP, fh.Filename, err)
-				return result
+	return h.finishFile(ctx, t, dr, opts, start)
+}
+
+// finishFile 对解密结果执行嗅探、转码或原样输出，并写入标签
+func (h *ConvertHandler) finishFile(ctx context.Context, t *fileTask, dr *service.DecryptResult, opts convertOptions, start time.Time) types.ConvertResult {
+	logger := logging.FromContext(ctx)
+	name := t.result.OrigName
+
+	out, err := h.converter.Finish(ctx, dr, name, t.outBase, service.Options(opts), service.Hooks{
+		OnPlan: func(out *service.Output) {
+			t.emit(types.EventFormat, types.FileEvent{
+				SourceFormat: out.SourceFormat,
+				Action:       out.Action,
+				Format:       out.Format.Name,
+			})
+			if out.Action == service.ActionTranscode {
+				t.setState(types.StateTranscoding)
 			}
-			_ = os.Remove(outRaw)
-		}
-	} else {
-		// 需要转码为FLAC
-		if err := h.convertToFlac(outRaw, finalPath); err != nil {
-			result.Err = fmt.Errorf("转码为FLAC失败: %w", err)
-			log.Printf("[ERR] ffmpeg convert failed ip=%s name=%s err=%v", clientIP, fh.Filename, err)
-			return result
+		},
+		OnProgress: func(percent float64) {
+			t.emit(types.EventProgress, types.FileEvent{Percent: percent})
+		},
+	})
+	if out != nil {
+		t.result.SourceFormat = out.SourceFormat
+		t.result.Action = out.Action
+	}
+	if err != nil {
+		logger.Warn("convert failed", zap.String("name", name), zap.String("code", types.ErrorCode(err)), zap.Error(err))
+		return t.fail(fileError(types.ErrorCode(err), err))
+	}
+	logger.Info("plan",
+		zap.String("name", name),
+		zap.String("source", out.SourceFormat),
+		zap.String("action", out.Action),
+		zap.String("out", out.Format.Name))
+	if out.TagErr != nil {
+		logger.Warn("write metadata failed", zap.String("name", name), zap.Error(out.TagErr))
+	}
+	if out.Action == service.ActionTranscode {
+		h.metrics.transcodeSeconds.WithLabelValues(out.Format.Name).Observe(out.Transcode.Seconds())
+	}
+	if h.cache != nil && t.cacheKey != "" {
+		err := h.cache.Put(t.cacheKey, out.Path, service.CachedResult{
+			Ext:          out.Format.Ext,
+			Cipher:       t.result.Cipher,
+			SourceFormat: out.SourceFormat,
+			Action:       out.Action,
+		})
+		if err != nil {
+			logger.Warn("cache store failed", zap.String("name", name), zap.Error(err))
 		}
-		_ = os.Remove(outRaw)
 	}
 
-	result.OutPath = finalPath
-	result.Duration = time.Since(start)
-	log.Printf("[FILE DONE] ip=%s name=%s out=%s dur=%s", clientIP, fh.Filename, finalPath, result.Duration)
+	t.result.OutPath = out.Path
+	t.done(start)
+	logger.Info("file done", zap.String("name", name), zap.String("out", out.Path), zap.Duration("dur", t.result.Duration))
 
-	return result
+	return t.result
+}
+
+// fromCache 命中缓存时将缓存的输出放入工作目录并完成 t，返回是否命中
+func (h *ConvertHandler) fromCache(ctx context.Context, t *fileTask, start time.Time) bool {
+	if h.cache == nil || t.cacheKey == "" {
+		return false
+	}
+	name := t.result.OrigName
+	meta, path, ok := h.cache.Get(t.cacheKey, t.outBase)
+	if !ok {
+		logging.FromContext(ctx).Debug("cache miss", zap.String("name", name), zap.String("key", t.cacheKey[:16]))
+		return false
+	}
+
+	t.result.Cipher = meta.Cipher
+	t.result.SourceFormat = meta.SourceFormat
+	t.result.Action = meta.Action
+	t.result.Cached = true
+	t.result.OutPath = path
+	t.done(start)
+	logging.FromContext(ctx).Info("cache hit", zap.String("name", name), zap.String("key", t.cacheKey[:16]), zap.String("out", path))
+	return true
+}
+
+// fileSHA256 计算文件内容的 SHA-256
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
 }
 
-func (h *ConvertHandler) serveSingleFile(w http.ResponseWriter, r *http.Request, results []types.ConvertResult, clientIP string) {
+func (h *ConvertHandler) serveSingleFile(w http.ResponseWriter, r *http.Request, results []types.ConvertResult) {
 	var fileToServe string
-	var origName string
+	var cipher string
+	var action string
 
 	for _, rr := range results {
 		if rr.Err == nil {
 			fileToServe = rr.OutPath
-			origName = rr.OrigName
+			cipher = rr.Cipher
+			action = rr.Action
 			break
 		}
 	}
@@ -720,181 +1295,290 @@ func (h *ConvertHandler) serveSingleFile(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	log.Printf("[RESP] ip=%s serve single file=%s size=%d", clientIP, fileToServe, utils.FileSizeSafe(fileToServe))
-	w.Header().Set("Content-Type", "audio/flac")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", utils.ReplaceExt(origName, ".flac")))
+	logging.FromContext(r.Context()).Info("serve single file", zap.String("file", fileToServe), zap.Int64("size", utils.FileSizeSafe(fileToServe)))
+	w.Header().Set("Content-Type", service.MIMEByExt(filepath.Ext(fileToServe)))
+	w.Header().Set("X-Source-Cipher", cipher)
+	w.Header().Set("X-Convert-Action", action)
+	if report, err := reportHeaderValue(results); err == nil {
+		w.Header().Set(reportHeader, report)
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(filepath.Base(fileToServe)))
 	http.ServeFile(w, r, fileToServe)
 }
 
-func (h *ConvertHandler) serveZipFile(w http.ResponseWriter, r *http.Request, results []types.ConvertResult, workDir, clientIP string) {
-	zipPath := filepath.Join(workDir, "kgm2flac_result_"+utils.RandHex(8)+".zip")
-	zipFile, err := os.Create(zipPath)
-	if err != nil {
-		http.Error(w, "无法创建zip文件: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("[ERR] create zip failed ip=%s err=%v", clientIP, err)
-		return
+// contentDisposition 生成 attachment 响应头：filename 为 ASCII 回退名，
+// 文件名含非 ASCII 字符时另以 filename*（RFC 5987）携带 UTF-8 原名
+func contentDisposition(name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, name)
+	if fallback == name {
+		return fmt.Sprintf(`attachment; filename="%s"`, name)
 	}
-	defer zipFile.Close()
 
-	zw := zip.NewWriter(zipFile)
-	defer zw.Close()
+	var b strings.Builder
+	for _, c := range []byte(name) {
+		if c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, b.String())
+}
 
-	// 添加成功文件到zip
-	successCount := 0
+// serveZipFile 将所有成功的文件以 zip 流式写入响应
+func (h *ConvertHandler) serveZipFile(w http.ResponseWriter, r *http.Request, results []types.ConvertResult) {
+	logger := logging.FromContext(r.Context())
+	logger.Info("stream zip")
+	zs := newZipStream(w, logger)
 	for _, rr := range results {
 		if rr.Err != nil || rr.OutPath == "" {
 			continue
 		}
-		if err := h.addFileToZip(zw, rr.OutPath, filepath.Base(rr.OutPath)); err != nil {
-			log.Printf("[ERR] add to zip failed ip=%s file=%s err=%v", clientIP, rr.OutPath, err)
-			continue
-		}
-		successCount++
+		zs.add(rr)
 	}
+	zs.close(results)
+}
+
+// zipStream 直接向响应写入 zip，每写完一个文件就刷新，不在磁盘上生成完整压缩包。
+// 响应头在创建时即发送，之后出错只能记录日志并中止写入
+type zipStream struct {
+	w      http.ResponseWriter
+	zw     *zip.Writer
+	logger *zap.Logger
+	count  int
+	err    error
+}
+
+func newZipStream(w http.ResponseWriter, logger *zap.Logger) *zipStream {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("kgm2flac_result.zip"))
+	return &zipStream{w: w, zw: zip.NewWriter(w), logger: logger}
+}
 
-	if err := zw.Close(); err != nil {
-		http.Error(w, "无法生成zip: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("[ERR] close zip failed ip=%s err=%v", clientIP, err)
+// add 写入一个转换结果，之前已出错时忽略
+func (z *zipStream) add(rr types.ConvertResult) {
+	if z.err != nil {
 		return
 	}
-
-	if successCount == 0 {
-		http.Error(w, "没有成功的文件可打包", http.StatusInternalServerError)
+	if err := addFileToZip(z.zw, rr.OutPath, filepath.Base(rr.OutPath), "cipher="+rr.Cipher); err != nil {
+		z.err = err
+		z.logger.Error("add to zip failed", zap.String("file", rr.OutPath), zap.Error(err))
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", `attachment; filename="kgm2flac_result.zip"`)
-	http.ServeFile(w, r, zipPath)
+	z.count++
+	if err := z.zw.Flush(); err == nil {
+		_ = http.NewResponseController(z.w).Flush()
+	}
 }
 
-func (h *ConvertHandler) persistUpload(src multipart.File, hdr *multipart.FileHeader) (path string, cleanup func(), err error) {
-	// 读取开头4字节以便后续检查
-	b := make([]byte, 4)
-	if _, err := io.ReadFull(src, b); err != nil && err != io.EOF {
-		return "", func() {}, err
+// close 写入包含所有结果（含失败文件）的 manifest.json 与 report.txt，再写入 zip 目录结束响应
+func (z *zipStream) close(results []types.ConvertResult) {
+	if z.err != nil {
+		return
+	}
+	if err := writeReport(z.zw, results); err != nil {
+		z.logger.Error("write zip report failed", zap.Error(err))
+		return
 	}
-	if _, err := src.Seek(0, io.SeekStart); err != nil {
-		// 忽略Seek错误，继续处理
+	if err := z.zw.Close(); err != nil {
+		z.logger.Error("close zip failed", zap.Error(err))
+		return
 	}
+	z.logger.Info("zip done", zap.Int("files", z.count))
+}
 
-	name := fmt.Sprintf("kgm_%s%s", utils.RandHex(8), filepath.Ext(hdr.Filename))
-	path = filepath.Join(os.TempDir(), name)
+// persistUpload 将上传流写入 dir 下的临时文件
+func (h *ConvertHandler) persistUpload(src io.Reader, filename, dir string) (string, error) {
+	name := fmt.Sprintf("kgm_%s%s", utils.RandHex(8), filepath.Ext(filename))
+	path := filepath.Join(dir, name)
 	f, err := os.Create(path)
 	if err != nil {
-		return "", func() {}, err
+		return "", err
 	}
 	defer f.Close()
 
 	if _, err = io.Copy(f, src); err != nil {
-		return "", func() {}, err
+		_ = os.Remove(path)
+		return "", err
 	}
-
-	return path, func() { _ = os.Remove(path) }, nil
+	return path, nil
 }
 
-func (h *ConvertHandler) sniffAudioExt(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
+// convertOptions 是单次请求的转换选项
+type convertOptions service.Options
 
-	head := make([]byte, 12)
-	if _, err := io.ReadFull(f, head); err != nil {
-		return "", err
+// resolveOptions 以配置为默认值，读取查询参数中的转换选项；
+// 表单中的同名字段由 readUploads 在文件之前读取并覆盖
+func (h *ConvertHandler) resolveOptions(r *http.Request) (convertOptions, error) {
+	opts := convertOptions{
+		Format:        h.cfg.DefaultFormat,
+		StripMetadata: h.cfg.StripMetadata,
+	}
+	if _, ok := service.ValidChoice(opts.Format); !ok {
+		return opts, types.NewError(types.CodeInternal, fmt.Errorf("配置的默认输出格式 %q 无效", opts.Format))
 	}
 
-	switch {
-	case bytes.HasPrefix(head, []byte("fLaC")):
-		return ".flac", nil
-	case bytes.HasPrefix(head, []byte("ID3")):
-		return ".mp3", nil
-	case head[0] == 0xFF && (head[1]&0xE0) == 0xE0:
-		return ".mp3", nil
-	case bytes.HasPrefix(head, []byte("OggS")):
-		return ".ogg", nil
-	default:
-		return "", fmt.Errorf("未知音频头: %x", head)
+	query := r.URL.Query()
+	for _, key := range optionFields {
+		if v := query.Get(key); v != "" {
+			if err := opts.apply(key, v); err != nil {
+				return opts, err
+			}
+		}
 	}
+	return opts, nil
 }
 
-func (h *ConvertHandler) convertToFlac(inputPath, outputPath string) error {
-	cmd := exec.Command(h.cfg.FFmpegBin,
-		"-y",
-		"-hide_banner",
-		"-loglevel", "error",
-		"-i", inputPath,
-		"-map_metadata", "-1",
-		outputPath,
-	)
+// optionFields 是可通过查询参数或表单字段设置的选项
+var optionFields = []string{"format", "strip_metadata"}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ffmpeg执行失败: %w", err)
+// apply 设置单个选项：format 为输出格式或模式（auto/passthrough），strip_metadata 控制是否清除标签
+func (o *convertOptions) apply(key, value string) error {
+	switch key {
+	case "format":
+		choice, ok := service.ValidChoice(value)
+		if !ok {
+			return types.NewError(types.CodeInvalidOption, fmt.Errorf("不支持的输出格式 %q，可选: %s", value, strings.Join(service.Choices(), ", ")))
+		}
+		o.Format = choice
+	case "strip_metadata":
+		strip, err := strconv.ParseBool(value)
+		if err != nil {
+			return types.NewError(types.CodeInvalidOption, fmt.Errorf("strip_metadata 取值无效: %q", value))
+		}
+		o.StripMetadata = strip
 	}
 	return nil
 }
 
-func (h *ConvertHandler) copyFile(src, dst string) error {
-	in, err := os.Open(src)
+// addFileToZip 以 Store 方式写入文件，音频本身已压缩，再次 Deflate 几乎没有收益。
+// 响应流无法回写本地文件头，因此先计算 CRC32 与大小再以 CreateRaw 写入，
+// 不使用数据描述符，边下载边解压的工具可以直接从本地文件头得到大小
+func addFileToZip(zw *zip.Writer, path string, nameInZip string, comment string) error {
+	in, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
+	finfo, err := in.Stat()
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	if _, err := io.Copy(out, in); err != nil {
+	fh, err := zip.FileInfoHeader(finfo)
+	if err != nil {
 		return err
 	}
-	return out.Sync()
-}
 
-func (h *ConvertHandler) addFileToZip(zw *zip.Writer, path string, nameInZip string) error {
-	finfo, err := os.Stat(path)
-	if err != nil {
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, in); err != nil {
 		return err
 	}
-
-	fh, err := zip.FileInfoHeader(finfo)
-	if err != nil {
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
 
 	fh.Name = nameInZip
-	fh.Method = zip.Deflate
-
-	w, err := zw.CreateHeader(fh)
+	fh.Comment = comment
+	fh.Method = zip.Store
+	fh.CRC32 = crc.Sum32()
+	fh.CompressedSize64 = fh.UncompressedSize64
+	w, err := createRaw(zw, fh)
 	if err != nil {
 		return err
 	}
+	_, err = io.CopyN(w, in, finfo.Size())
+	return err
+}
 
-	in, err := os.Open(path)
-	if err != nil {
-		return err
+// createRaw 以 CreateRaw 写入已知 CRC32 与大小的条目，
+// 并补全 CreateHeader 会自动设置而 CreateRaw 不会设置的版本号与 UTF-8 标志
+func createRaw(zw *zip.Writer, fh *zip.FileHeader) (io.Writer, error) {
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | 20
+	fh.ReaderVersion = 20
+	if strings.IndexFunc(fh.Name+fh.Comment, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+		fh.Flags |= 0x800 // 文件名为 UTF-8 编码
 	}
-	defer in.Close()
-
-	_, err = io.Copy(w, in)
-	return err
+	return zw.CreateRaw(fh)
 }
 
 // StartServer 启动HTTP服务器
-func StartServer(cfg *config.Config) error {
-	handler := NewConvertHandler(cfg)
+func StartServer(cfg *config.Config, build types.BuildInfo) error {
+	handler, err := NewConvertHandler(cfg, build)
+	if err != nil {
+		return err
+	}
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/", handler.HandleRoot)
-	mux.HandleFunc("/api/convert", handler.HandleConvert)
+	m := handler.metrics
+	// "/{$}" 只匹配根路径，其他未注册的路径返回 404
+	mux.HandleFunc("/{$}", handler.HandleRoot)
+	mux.HandleFunc("GET /healthz", handler.HandleHealthz)
+	mux.HandleFunc("GET /readyz", handler.HandleReadyz)
+	// /api/* 按客户端 IP 限流，配置了 API 密钥时还需要认证
+	api := func(f http.HandlerFunc) http.Handler {
+		return m.instrument(handler.limiter.limit(handler.auth.require(f)).ServeHTTP)
+	}
+	mux.Handle("GET /api/version", handler.limiter.limit(handler.auth.require(http.HandlerFunc(handler.HandleVersion))))
+	mux.Handle("/api/convert", api(handler.HandleConvert))
+	mux.Handle("POST /api/jobs", api(handler.HandleCreateJob))
+	mux.Handle("GET /api/jobs/{id}", api(handler.HandleJobStatus))
+	mux.Handle("GET /api/jobs/{id}/download", api(handler.HandleJobDownload))
+	mux.Handle("GET /api/jobs/{id}/events", api(handler.HandleJobEvents))
+	if handler.uploads != nil {
+		// tus 可续传上传，完成后通过 POST /api/jobs 引用
+		mux.HandleFunc("OPTIONS /api/uploads", handler.HandleUploadOptions)
+		mux.HandleFunc("OPTIONS /api/uploads/{id}", handler.HandleUploadOptions)
+		mux.Handle("POST /api/uploads", api(tus(handler.HandleUploadCreate)))
+		mux.Handle("HEAD /api/uploads/{id}", api(tus(handler.HandleUploadHead)))
+		mux.Handle("PATCH /api/uploads/{id}", api(tus(handler.HandleUploadPatch)))
+		mux.Handle("DELETE /api/uploads/{id}", api(tus(handler.HandleUploadDelete)))
+	}
+	mux.Handle("GET /metrics", m.handler())
+
+	logger := zap.L()
+	logger.Info("启动服务器",
+		zap.String("version", build.Version),
+		zap.String("commit", build.CommitHash),
+		zap.String("addr", cfg.Addr),
+		zap.String("ffmpeg", cfg.FFmpegBin),
+		zap.Int64("max_file_size", cfg.MaxFileSize),
+		zap.Int("max_files", cfg.MaxFiles),
+		zap.Int("workers", cfg.Workers),
+		zap.Int("max_ffmpeg", cfg.MaxFFmpeg),
+		zap.Duration("shutdown_timeout", cfg.ShutdownTimeout))
+
+	// 清理其他实例异常退出遗留的临时文件
+	if n := handler.sweepTempFiles(); n > 0 {
+		logger.Info("已清理遗留临时文件", zap.Int("count", n))
+	}
+
+	srv := &http.Server{
+		Addr:     cfg.Addr,
+		Handler:  logRequest(handler.proxies, mux),
+		ErrorLog: zap.NewStdLog(logger.Named("http")),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Printf("启动服务器，监听地址: %s", cfg.Addr)
-	log.Printf("FFmpeg路径: %s", cfg.FFmpegBin)
-	log.Printf("单文件最大大小: %d bytes", cfg.MaxFileSize)
-	log.Printf("最大文件数: %d", cfg.MaxFiles)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
 
-	return http.ListenAndServe(cfg.Addr, logRequest(mux))
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	// 恢复默认信号处理，再次收到信号时立即退出
+	stop()
+
+	logger.Info("收到退出信号，停止接收新上传", zap.Duration("timeout", cfg.ShutdownTimeout))
+	handler.Shutdown(srv, cfg.ShutdownTimeout)
+	logger.Info("服务已退出")
+	return nil
 }
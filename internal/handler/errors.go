@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"kgm2flac-backend/internal/service"
+	"kgm2flac-backend/pkg/types"
+)
+
+// wantsJSON 判断客户端是否通过 Accept 请求 JSON 响应
+func wantsJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil && mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeError 按 Accept 返回 JSON 错误（含错误码）或纯文本
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if !wantsJSON(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, status, struct {
+		Error types.APIError `json:"error"`
+	}{types.APIError{Code: types.ErrorCode(err), Message: err.Error()}})
+}
+
+// writeUploadError 返回读取上传失败的错误：超出每日配额或频率限制为 429 并附带 Retry-After，
+// 引用的可续传上传不存在为 404、尚未完成为 409，其余为 400
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var limited *rateLimitedError
+	switch {
+	case types.ErrorCode(err) == types.CodeQuotaExceeded:
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(nextMidnight()).Seconds())+1))
+		writeError(w, r, http.StatusTooManyRequests, err)
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(limited.wait)))
+		writeError(w, r, http.StatusTooManyRequests, err)
+	case types.ErrorCode(err) == types.CodeNotFound:
+		writeError(w, r, http.StatusNotFound, err)
+	case types.ErrorCode(err) == types.CodeUploadIncomplete:
+		writeError(w, r, http.StatusConflict, err)
+	default:
+		writeError(w, r, http.StatusBadRequest, err)
+	}
+}
+
+// fileError 为单个文件的错误附加错误码，超限、超时、取消等具体原因优先于 code
+func fileError(code string, err error) error {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		code = types.CodeFileTooLarge
+	case errors.Is(err, errQuotaExceeded):
+		code = types.CodeQuotaExceeded
+	case errors.As(err, &maxBytes):
+		code = types.CodeRequestTooLarge
+	case errors.Is(err, service.ErrUnknownCipher):
+		code = types.CodeUnsupportedCipher
+	case errors.Is(err, context.DeadlineExceeded):
+		code = types.CodeTimeout
+	case errors.Is(err, context.Canceled):
+		code = types.CodeCanceled
+	}
+	return types.NewError(code, err)
+}
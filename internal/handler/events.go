@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+// sseHeartbeat 是没有新事件时发送注释行的间隔，防止代理因空闲断开连接
+const sseHeartbeat = 15 * time.Second
+
+// jobEvent 是任务的一条进度事件，ID 从 1 开始递增
+type jobEvent struct {
+	ID   int
+	Type string
+	Data []byte // JSON
+}
+
+// eventLog 按顺序保存任务的全部事件，订阅者可以随时从头回放，
+// 或在重连时通过 Last-Event-ID 从断开处继续。任务结束后关闭
+type eventLog struct {
+	mu     sync.Mutex
+	events []jobEvent
+	closed bool
+	notify chan struct{} // 有新事件或关闭时关闭并替换
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{notify: make(chan struct{})}
+}
+
+// publish 追加一条事件并唤醒等待的订阅者，关闭后的事件被丢弃
+func (l *eventLog) publish(typ string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		zap.L().Warn("marshal event failed", zap.String("event", typ), zap.Error(err))
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.events = append(l.events, jobEvent{ID: len(l.events) + 1, Type: typ, Data: data})
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// close 标记不会再有新事件
+func (l *eventLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.notify)
+	}
+}
+
+// since 返回 ID 大于 after 的事件、有新事件时会被关闭的 channel，以及事件是否已全部发布
+func (l *eventLog) since(after int) ([]jobEvent, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []jobEvent
+	if after < len(l.events) {
+		events = l.events[max(after, 0):]
+	}
+	return events, l.notify, l.closed
+}
+
+// emit 发布该文件的进度事件，同步转换没有事件订阅时忽略
+func (t *fileTask) emit(typ string, ev types.FileEvent) {
+	if t.events == nil {
+		return
+	}
+	ev.Index = t.index
+	ev.Name = t.result.OrigName
+	t.events.publish(typ, ev)
+}
+
+// publishResult 发布文件的最终状态
+func publishResult(events *eventLog, i int, r types.ConvertResult) {
+	fs := types.NewFileStatus(r)
+	events.publish(types.EventResult, types.FileEvent{Index: i, Name: r.OrigName, Result: &fs})
+}
+
+// HandleJobEvents 以 Server-Sent Events 推送任务进度：先回放已发生的事件，
+// 之后实时推送，任务结束时发送 done 事件并关闭连接
+func (h *ConvertHandler) HandleJobEvents(w http.ResponseWriter, r *http.Request) {
+	j, ok := h.ownJob(w, r)
+	if !ok {
+		return
+	}
+
+	after := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		after, _ = strconv.Atoi(v)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// 关闭 nginx 的响应缓冲，事件才能及时到达
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, notify, closed := j.events.since(after)
+		for _, ev := range events {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data); err != nil {
+				return
+			}
+			after = ev.ID
+		}
+		if err := rc.Flush(); err != nil {
+			logging.FromContext(r.Context()).Debug("flush events failed", zap.Error(err))
+			return
+		}
+		if closed {
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-h.streamsDone:
+			// 服务关闭时断开长连接，客户端按 retry 稍后重连
+			fmt.Fprint(w, "retry: 5000\n\n")
+			_ = rc.Flush()
+			return
+		}
+	}
+}
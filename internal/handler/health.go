@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"kgm2flac-backend/internal/utils"
+)
+
+// readiness 是 /readyz 的响应，checks 中每项为 ok 或失败原因
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HandleHealthz 存活探针，进程能响应即返回 200
+func (h *ConvertHandler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// HandleReadyz 就绪探针：未在关闭中、ffmpeg 可执行、临时目录可写且剩余空间不低于 min_free_space
+func (h *ConvertHandler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	res := readiness{Status: "ok", Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			res.Status = "fail"
+			res.Checks[name] = err.Error()
+			return
+		}
+		res.Checks[name] = "ok"
+	}
+
+	if h.draining.Load() {
+		check("shutdown", errShuttingDown)
+	}
+	_, err := exec.LookPath(h.cfg.FFmpegBin)
+	check("ffmpeg", err)
+	check("temp_dir", checkWritable(os.TempDir()))
+	check("disk_space", checkFreeSpace(os.TempDir(), h.cfg.MinFreeSpace))
+
+	status := http.StatusOK
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, res)
+}
+
+// HandleVersion 返回编译时注入的版本信息
+func (h *ConvertHandler) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.build)
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, "kgm2flac_ready_*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
+
+func checkFreeSpace(dir string, min int64) error {
+	if min <= 0 {
+		return nil
+	}
+	free, err := utils.DiskFree(dir)
+	if err != nil {
+		return err
+	}
+	if free < uint64(min) {
+		return fmt.Errorf("剩余空间 %d bytes 低于 %d bytes", free, min)
+	}
+	return nil
+}
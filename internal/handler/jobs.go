@@ -0,0 +1,396 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+var errJobNotFound = types.NewError(types.CodeNotFound, errors.New("任务不存在"))
+
+// job 表示一次异步转换任务
+type job struct {
+	mu         sync.Mutex
+	id         string
+	clientIP   string
+	owner      string      // 创建任务的 API 密钥名称，未启用认证时为空
+	logger     *zap.Logger // 带有创建任务的请求 ID，后台处理沿用
+	lease      *keyLease   // 占用的 API 密钥并发名额，任务结束时释放
+	workDir    string
+	opts       convertOptions
+	inputs     []string // 与 results 一一对应，落盘失败时为空
+	outBases   []string // 与 results 一一对应的输出路径（不含扩展名），批次内唯一
+	results    []types.ConvertResult
+	events     *eventLog // 进度事件，任务结束后关闭
+	state      string
+	createdAt  time.Time
+	finishedAt time.Time
+}
+
+// jobStore 在内存中保存任务，并定期清理过期任务
+type jobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*job
+	ttl  time.Duration
+}
+
+func newJobStore(ttl time.Duration) *jobStore {
+	s := &jobStore{
+		jobs: make(map[string]*job),
+		ttl:  ttl,
+	}
+	go s.janitor()
+	return s
+}
+
+func (s *jobStore) add(j *job) {
+	s.mu.Lock()
+	s.jobs[j.id] = j
+	s.mu.Unlock()
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// janitor 删除完成时间超过 ttl 的任务及其工作目录
+func (s *jobStore) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*job
+		s.mu.Lock()
+		for id, j := range s.jobs {
+			j.mu.Lock()
+			if j.state == types.JobDone && time.Since(j.finishedAt) > s.ttl {
+				expired = append(expired, j)
+				delete(s.jobs, id)
+			}
+			j.mu.Unlock()
+		}
+		s.mu.Unlock()
+
+		for _, j := range expired {
+			_ = os.RemoveAll(j.workDir)
+			zap.L().Info("job expired", zap.String("job_id", j.id))
+		}
+	}
+}
+
+// removeAll 删除所有任务及其工作目录，在服务关闭时调用
+func (s *jobStore) removeAll() {
+	s.mu.Lock()
+	jobs := s.jobs
+	s.jobs = make(map[string]*job)
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		_ = os.RemoveAll(j.workDir)
+	}
+}
+
+// status 生成任务状态快照
+func (j *job) status() types.JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	st := types.JobStatus{
+		ID:        j.id,
+		State:     j.state,
+		Total:     len(j.results),
+		CreatedAt: j.createdAt,
+		Files:     make([]types.FileStatus, 0, len(j.results)),
+	}
+	for _, r := range j.results {
+		switch r.State {
+		case types.StateDone:
+			st.Success++
+		case types.StateFailed:
+			st.Failed++
+		}
+		st.Files = append(st.Files, types.NewFileStatus(r))
+	}
+	if j.state == types.JobDone {
+		finished := j.finishedAt
+		st.FinishedAt = &finished
+		if st.Success > 0 {
+			st.DownloadURL = "/api/jobs/" + j.id + "/download"
+		}
+	}
+	return st
+}
+
+// snapshot 返回结果副本，供下载时使用
+func (j *job) snapshot() (string, []types.ConvertResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	results := make([]types.ConvertResult, len(j.results))
+	copy(results, j.results)
+	return j.state, results
+}
+
+// finish 发布 done 事件并关闭事件流，返回最终状态
+func (j *job) finish() types.JobStatus {
+	st := j.status()
+	j.events.publish(types.EventDone, st)
+	j.events.close()
+	return st
+}
+
+func (j *job) setFileState(i int, state string) {
+	j.mu.Lock()
+	j.results[i].State = state
+	j.mu.Unlock()
+}
+
+// HandleCreateJob 接收上传文件并立即返回任务ID，转换在后台进行
+func (h *ConvertHandler) HandleCreateJob(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+	logger := logging.FromContext(r.Context())
+
+	// 先登记再检查关闭状态，保证关闭时等待的任务不会遗漏
+	h.running.Add(1)
+	started := false
+	defer func() {
+		if !started {
+			h.running.Done()
+		}
+	}()
+	if h.rejectIfDraining(w, r) {
+		return
+	}
+
+	opts, err := h.resolveOptions(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	workDir, err := os.MkdirTemp(h.tempDir, "job_*")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("无法创建临时工作目录: %w", err))
+		logger.Error("mkdir temp failed", zap.Error(err))
+		return
+	}
+
+	id := utils.RandHex(16)
+	j := &job{
+		id:        id,
+		clientIP:  clientIP,
+		owner:     leaseFromContext(r.Context()).name(),
+		logger:    logger.With(zap.String("job_id", id)),
+		workDir:   workDir,
+		events:    newEventLog(),
+		state:     types.JobQueued,
+		createdAt: time.Now(),
+	}
+
+	// 后台任务在请求结束后才处理，因此边接收边将上传内容落盘到任务目录；
+	// JSON 请求体则引用已通过 /api/uploads 完成的可续传上传
+	if contentType(r) == "application/json" {
+		err = h.takeUploads(r, j, &opts)
+	} else {
+		err = h.readJobUploads(w, r, j, &opts)
+	}
+	if err != nil {
+		_ = os.RemoveAll(workDir)
+		writeUploadError(w, r, err)
+		logger.Warn("read upload failed", zap.Error(err))
+		return
+	}
+	j.opts = opts
+	j.lease = leaseFromContext(r.Context()).detach()
+
+	h.jobs.add(j)
+	started = true
+	go h.runJob(j)
+
+	j.logger.Info("job created",
+		zap.Int("files", len(j.results)),
+		zap.String("format", opts.Format),
+		zap.Bool("strip_metadata", opts.StripMetadata))
+
+	w.Header().Set("Location", "/api/jobs/"+j.id)
+	writeJSON(w, http.StatusAccepted, j.status())
+}
+
+// readJobUploads 读取 multipart 请求中的文件并保存到任务目录
+func (h *ConvertHandler) readJobUploads(w http.ResponseWriter, r *http.Request, j *job, opts *convertOptions) error {
+	names := utils.NewNameSet()
+	_, err := h.readUploads(w, r, opts, func(name string, body io.Reader) error {
+		res := types.ConvertResult{
+			OrigName: name,
+			Format:   opts.Format,
+			State:    types.StateQueued,
+		}
+		src := &sizeLimitReader{r: body, max: h.cfg.MaxFileSize}
+		inPath, err := h.persistUpload(src, name, j.workDir)
+		res.Size = src.n
+		h.metrics.inputBytes.Observe(float64(src.n))
+		if err != nil {
+			j.logger.Error("save upload failed", zap.String("name", name), zap.Error(err))
+			res.Err = fileError(types.CodeUploadFailed, fmt.Errorf("保存上传文件失败: %w", err))
+			res.State = types.StateFailed
+			h.metrics.fileFailed(types.StateQueued, res.Err)
+		} else {
+			j.events.publish(types.EventReceived, types.FileEvent{Index: len(j.results), Name: name, Size: res.Size})
+		}
+		j.inputs = append(j.inputs, inPath)
+		j.outBases = append(j.outBases, filepath.Join(j.workDir, names.Claim(outputStem(name))))
+		j.results = append(j.results, res)
+		return nil
+	})
+	return err
+}
+
+// runJob 在后台并发处理任务中的文件
+func (h *ConvertHandler) runJob(j *job) {
+	defer h.running.Done()
+	defer j.lease.release()
+	start := time.Now()
+	ctx := logging.WithContext(h.ctx, j.logger)
+	j.mu.Lock()
+	j.state = types.JobRunning
+	j.mu.Unlock()
+
+	runPool(len(j.inputs), h.cfg.Workers, func(i int) {
+		j.mu.Lock()
+		result := j.results[i]
+		j.mu.Unlock()
+		inPath := j.inputs[i]
+		if inPath == "" {
+			publishResult(j.events, i, result)
+			return
+		}
+
+		t := &fileTask{
+			result:  result,
+			outBase: j.outBases[i],
+			index:   i,
+			events:  j.events,
+			onState: func(state string) { j.setFileState(i, state) },
+		}
+		result = h.convertFile(ctx, t, inPath, j.opts, j.workDir, time.Now())
+		_ = os.Remove(inPath)
+
+		j.mu.Lock()
+		j.results[i] = result
+		j.mu.Unlock()
+		publishResult(j.events, i, result)
+	})
+
+	j.mu.Lock()
+	j.state = types.JobDone
+	j.finishedAt = time.Now()
+	j.mu.Unlock()
+
+	st := j.finish()
+	j.logger.Info("job done",
+		zap.Int("total_files", st.Total),
+		zap.Int("success", st.Success),
+		zap.Duration("took", time.Since(start)))
+}
+
+// ownJob 取出路径参数指定的任务。启用认证时任务只对创建它的密钥可见，
+// 其他密钥与不存在的任务一样返回 404，不暴露任务是否存在
+func (h *ConvertHandler) ownJob(w http.ResponseWriter, r *http.Request) (*job, bool) {
+	j, ok := h.jobs.get(r.PathValue("id"))
+	if !ok || j.owner != leaseFromContext(r.Context()).name() {
+		writeError(w, r, http.StatusNotFound, errJobNotFound)
+		return nil, false
+	}
+	return j, true
+}
+
+// HandleJobStatus 返回任务及每个文件的状态
+func (h *ConvertHandler) HandleJobStatus(w http.ResponseWriter, r *http.Request) {
+	j, ok := h.ownJob(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, j.status())
+}
+
+// HandleJobDownload 在任务完成后下载结果
+func (h *ConvertHandler) HandleJobDownload(w http.ResponseWriter, r *http.Request) {
+	j, ok := h.ownJob(w, r)
+	if !ok {
+		return
+	}
+
+	state, results := j.snapshot()
+	if state != types.JobDone {
+		writeError(w, r, http.StatusConflict, types.NewError(types.CodeJobNotReady, fmt.Errorf("任务尚未完成（当前状态 %s）", state)))
+		return
+	}
+
+	successCount := 0
+	for _, rr := range results {
+		if rr.Err == nil {
+			successCount++
+		}
+	}
+
+	switch successCount {
+	case 0:
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeAllFailed, errors.New("所有文件处理失败")))
+	case 1:
+		h.serveSingleFile(w, r, results)
+	default:
+		h.serveZipFile(w, r, results)
+	}
+}
+
+// respondJSONResults 将同步转换的结果保存为已完成的任务，返回与任务查询相同的 JSON，
+// 有成功文件时状态码为 200，全部失败时为 422
+func (h *ConvertHandler) respondJSONResults(w http.ResponseWriter, r *http.Request, results []types.ConvertResult, workDir string) {
+	now := time.Now()
+	id := utils.RandHex(16)
+	j := &job{
+		id:         id,
+		clientIP:   getClientIP(r),
+		owner:      leaseFromContext(r.Context()).name(),
+		logger:     logging.FromContext(r.Context()).With(zap.String("job_id", id)),
+		workDir:    workDir,
+		results:    results,
+		events:     newEventLog(),
+		state:      types.JobDone,
+		createdAt:  now,
+		finishedAt: now,
+	}
+	// 订阅已完成任务的进度时直接得到每个文件的结果与 done 事件
+	for i, rr := range results {
+		publishResult(j.events, i, rr)
+	}
+	st := j.finish()
+	h.jobs.add(j)
+
+	status := http.StatusOK
+	if st.Success == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, st)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Warn("write json failed", zap.Error(err))
+	}
+}
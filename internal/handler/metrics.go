@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"kgm2flac-backend/internal/service"
+	"kgm2flac-backend/pkg/types"
+)
+
+const metricsNamespace = "kgm2flac"
+
+// metrics 是转换服务的 Prometheus 指标，注册在独立的 Registry 上
+type metrics struct {
+	registry         *prometheus.Registry
+	filesConverted   *prometheus.CounterVec
+	filesFailed      *prometheus.CounterVec
+	decryptSeconds   prometheus.Histogram
+	transcodeSeconds *prometheus.HistogramVec
+	inputBytes       prometheus.Histogram
+	inFlight         prometheus.Gauge
+	bytesIn          prometheus.Counter
+	bytesOut         prometheus.Counter
+}
+
+func newMetrics(conv *service.Converter, cache *service.ResultCache) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		filesConverted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "files_converted_total",
+			Help:      "成功处理的文件数，按源格式与处理方式（passthrough/transcode）区分",
+		}, []string{"source_format", "action"}),
+		filesFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "files_failed_total",
+			Help:      "处理失败的文件数，按失败时所处阶段与错误码区分",
+		}, []string{"stage", "code"}),
+		decryptSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "decrypt_duration_seconds",
+			Help:      "单文件解密耗时，流式上传时包含接收时间",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		}),
+		transcodeSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "transcode_duration_seconds",
+			Help:      "单文件 ffmpeg 转码耗时（含等待 ffmpeg 名额），按输出格式区分",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"format"}),
+		inputBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "input_size_bytes",
+			Help:      "上传的加密文件大小",
+			Buckets:   prometheus.ExponentialBuckets(1<<20, 2, 11), // 1MiB ~ 1GiB
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_in_flight",
+			Help:      "正在处理的接口请求数",
+		}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "received_bytes_total",
+			Help:      "接口请求体读取的字节数",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sent_bytes_total",
+			Help:      "接口响应体写出的字节数",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.filesConverted, m.filesFailed,
+		m.decryptSeconds, m.transcodeSeconds, m.inputBytes,
+		m.inFlight, m.bytesIn, m.bytesOut,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ffmpeg_processes",
+			Help:      "正在运行的 ffmpeg 进程数",
+		}, func() float64 { return float64(conv.RunningFFmpeg()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if cache != nil {
+		m.registry.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "cache_hits_total",
+				Help:      "结果缓存命中次数",
+			}, func() float64 { hits, _ := cache.Stats(); return float64(hits) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "cache_misses_total",
+				Help:      "结果缓存未命中次数",
+			}, func() float64 { _, misses := cache.Stats(); return float64(misses) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "cache_size_bytes",
+				Help:      "结果缓存占用的磁盘空间",
+			}, func() float64 { size, _ := cache.Size(); return float64(size) }),
+		)
+	}
+	return m
+}
+
+// handler 返回 /metrics 的处理器
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// fileConverted 记录一个成功的文件
+func (m *metrics) fileConverted(r types.ConvertResult) {
+	m.filesConverted.WithLabelValues(r.SourceFormat, r.Action).Inc()
+}
+
+// fileFailed 记录一个失败的文件，stage 为失败时的处理状态
+func (m *metrics) fileFailed(stage string, err error) {
+	m.filesFailed.WithLabelValues(stage, types.ErrorCode(err)).Inc()
+}
+
+// instrument 统计进行中的请求数与请求、响应字节数
+func (m *metrics) instrument(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		r.Body = &countingBody{ReadCloser: r.Body, counter: m.bytesIn}
+		next(&countingWriter{ResponseWriter: w, counter: m.bytesOut}, r)
+	})
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Add(float64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	counter prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
+// Unwrap 供 http.ResponseController 访问底层的 Flush 等能力
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -1,36 +1,165 @@
 package handler
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
+
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/internal/utils"
+
+	"go.uber.org/zap"
 )
 
-// logRequest 中间件记录请求基础信息、耗时等
-func logRequest(next http.Handler) http.Handler {
+const requestIDHeader = "X-Request-ID"
+
+// logRequest 中间件解析客户端 IP，为每个请求分配 X-Request-ID 并在响应中回显，
+// 将带有请求 ID 与客户端 IP 的 logger 放入 context，最后记录请求基础信息、耗时等
+func logRequest(proxies *trustedProxies, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		clientIP := getClientIP(r)
-		log.Printf("[REQ] %s %s ip=%s ua=%q took=%s",
-			r.Method, r.URL.Path, clientIP, r.UserAgent(), time.Since(start))
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		clientIP := proxies.clientIP(r)
+		logger := zap.L().With(zap.String("request_id", id), zap.String("ip", clientIP))
+		ctx := context.WithValue(r.Context(), clientIPKey{}, clientIP)
+		r = r.WithContext(logging.WithContext(ctx, logger))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		logger.Info("request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", sw.status),
+			zap.String("ua", r.UserAgent()),
+			zap.Duration("took", time.Since(start)))
 	})
 }
 
-// getClientIP 尝试从 X-Forwarded-For, X-Real-IP 获取真实客户端 IP
+// requestID 沿用上游传入的合法 X-Request-ID，否则生成新的
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 64 {
+		return utils.RandHex(16)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return utils.RandHex(16)
+		}
+	}
+	return id
+}
+
+// statusWriter 记录响应状态码
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap 供 http.ResponseController 访问底层的 Flush 等能力
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type clientIPKey struct{}
+
+// getClientIP 返回 logRequest 解析出的客户端 IP
 func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			return strings.TrimSpace(parts[0])
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// trustedProxies 是可信代理的地址段，只有直连地址属于其中时才采信转发头
+type trustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// newTrustedProxies 解析 IP 或 CIDR 列表
+func newTrustedProxies(list []string) (*trustedProxies, error) {
+	p := &trustedProxies{}
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("无效的可信代理地址 %q: %w", s, err)
+			}
+			p.prefixes = append(p.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("无效的可信代理地址 %q: %w", s, err)
+		}
+		p.prefixes = append(p.prefixes, prefix.Masked())
+	}
+	return p, nil
+}
+
+func (p *trustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 返回真实客户端 IP：直连地址不是可信代理时直接使用，否则从右向左遍历
+// X-Forwarded-For，跳过可信代理，第一个不可信的地址即为客户端；没有 X-Forwarded-For 时使用 X-Real-IP
+func (p *trustedProxies) clientIP(r *http.Request) string {
+	remote := remoteHost(r)
+	addr, err := netip.ParseAddr(remote)
+	if err != nil || !p.trusted(addr) {
+		return remote
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		if xr := strings.TrimSpace(r.Header.Get("X-Real-Ip")); xr != "" {
+			if _, err := netip.ParseAddr(xr); err == nil {
+				return xr
+			}
 		}
+		return remote
 	}
-	if xr := r.Header.Get("X-Real-Ip"); xr != "" {
-		return strings.TrimSpace(xr)
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// 无法解析的条目之前的内容都不可信
+			break
+		}
+		client = hop.Unmap().String()
+		if !p.trusted(hop) {
+			break
+		}
 	}
-	// strip port if present
+	return client
+}
+
+// remoteHost 返回直连地址，去掉端口
+func remoteHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return r.RemoteAddr
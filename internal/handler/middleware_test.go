@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "直连不可信时忽略转发头", remote: "203.0.113.5:1234", xff: []string{"1.1.1.1"}, realIP: "2.2.2.2", want: "203.0.113.5"},
+		{name: "可信代理没有转发头", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "单个客户端", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1"}, want: "1.1.1.1"},
+		{name: "跳过多级可信代理", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, 10.0.0.3, 10.0.0.2"}, want: "1.1.1.1"},
+		{name: "客户端伪造的条目被忽略", remote: "10.0.0.1:1234", xff: []string{"6.6.6.6, 1.1.1.1"}, want: "1.1.1.1"},
+		{name: "多个转发头按顺序合并", remote: "10.0.0.1:1234", xff: []string{"6.6.6.6", "1.1.1.1, 10.0.0.2"}, want: "1.1.1.1"},
+		{name: "全部为可信代理时取最左", remote: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "无法解析的条目之前不可信", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, junk, 2.2.2.2"}, want: "2.2.2.2"},
+		{name: "最右条目无法解析时用直连地址", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1, junk"}, want: "10.0.0.1"},
+		{name: "IPv4 映射地址", remote: "10.0.0.1:1234", xff: []string{"::ffff:1.1.1.1"}, want: "1.1.1.1"},
+		{name: "IPv6 可信代理", remote: "[::1]:1234", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "没有转发头时使用 X-Real-IP", remote: "10.0.0.1:1234", realIP: " 5.5.5.5 ", want: "5.5.5.5"},
+		{name: "X-Real-IP 无效", remote: "10.0.0.1:1234", realIP: "unknown", want: "10.0.0.1"},
+		{name: "X-Forwarded-For 优先于 X-Real-IP", remote: "10.0.0.1:1234", xff: []string{"1.1.1.1"}, realIP: "5.5.5.5", want: "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := proxies.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package handler
+
+import "sync"
+
+// runPool 使用最多 workers 个 goroutine 并发执行 fn(0..n-1)，结果顺序由调用方按下标写入保证
+func runPool(n, workers int, fn func(i int)) {
+	if workers <= 0 || workers > n {
+		workers = n
+	}
+
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+}
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/pkg/types"
+)
+
+// rateLimitedError 表示超出频率限制，wait 为建议的重试等待时间
+type rateLimitedError struct {
+	what string
+	wait time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("%s超出频率限制，请 %d 秒后重试", e.what, retrySeconds(e.wait))
+}
+
+func retrySeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// bucket 是令牌桶，容量为每分钟的量并按匀速补充。
+// 字节数在读取后才扣除，余额可以为负，之后的请求需等待补足
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill 按经过的时间补充令牌
+func (b *bucket) refill(now time.Time, perMinute float64) {
+	if b.last.IsZero() {
+		b.tokens = perMinute
+	} else {
+		b.tokens = math.Min(perMinute, b.tokens+now.Sub(b.last).Minutes()*perMinute)
+	}
+	b.last = now
+}
+
+// wait 返回令牌数达到 need 还需等待的时间
+func (b *bucket) wait(need, perMinute float64) time.Duration {
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / perMinute * float64(time.Minute))
+}
+
+// clientLimit 是单个客户端 IP 的请求、文件与字节令牌桶
+type clientLimit struct {
+	l        *rateLimiter
+	mu       sync.Mutex
+	requests bucket
+	files    bucket
+	bytes    bucket
+	seen     time.Time
+}
+
+type rateKey struct{}
+
+// rateLimiter 按客户端 IP 限制每分钟的请求数、上传文件数与上传字节数
+type rateLimiter struct {
+	cfg     config.RateLimitConfig
+	mu      sync.Mutex
+	clients map[string]*clientLimit
+}
+
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	if cfg.RequestsPerMinute <= 0 && cfg.FilesPerMinute <= 0 && cfg.BytesPerMinute <= 0 {
+		return nil
+	}
+	l := &rateLimiter{cfg: cfg, clients: make(map[string]*clientLimit)}
+	go l.janitor()
+	return l
+}
+
+// clientIdle 是删除客户端前要求的最短空闲时间，避免删除仍在上传的客户端
+const clientIdle = 5 * time.Minute
+
+// janitor 定期删除空闲的客户端
+func (l *rateLimiter) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.sweep(time.Now())
+	}
+}
+
+// sweep 删除空闲超过 clientIdle 且令牌桶已全部补满的客户端。
+// 字节余额可能为负，上传量远超每分钟限额的客户端需要更久才能补满，提前删除会免除其欠额
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, c := range l.clients {
+		c.mu.Lock()
+		if now.Sub(c.seen) > clientIdle && c.full(now) {
+			delete(l.clients, ip)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// full 补充令牌后判断已配置的令牌桶是否都已补满，此时删除客户端与保留它没有区别。调用方持有 c.mu
+func (c *clientLimit) full(now time.Time) bool {
+	cfg := c.l.cfg
+	for _, b := range []struct {
+		b         *bucket
+		perMinute float64
+	}{
+		{&c.requests, float64(cfg.RequestsPerMinute)},
+		{&c.files, float64(cfg.FilesPerMinute)},
+		{&c.bytes, float64(cfg.BytesPerMinute)},
+	} {
+		if b.perMinute <= 0 {
+			continue
+		}
+		b.b.refill(now, b.perMinute)
+		if b.b.tokens < b.perMinute {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *rateLimiter) client(ip string) *clientLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientLimit{l: l}
+		l.clients[ip] = c
+	}
+	return c
+}
+
+// limit 按客户端 IP 限流，超出时返回 429 与 Retry-After。未配置限流时不检查
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := l.client(getClientIP(r))
+		if err := c.allowRequest(); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(err.wait)))
+			writeError(w, r, http.StatusTooManyRequests, types.NewError(types.CodeRateLimited, err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateKey{}, c)))
+	})
+}
+
+func rateFromContext(ctx context.Context) *clientLimit {
+	c, _ := ctx.Value(rateKey{}).(*clientLimit)
+	return c
+}
+
+// allowRequest 扣除一个请求令牌；之前的上传已让字节余额为负时同样拒绝
+func (c *clientLimit) allowRequest() *rateLimitedError {
+	cfg := c.l.cfg
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen = now
+
+	if cfg.BytesPerMinute > 0 {
+		c.bytes.refill(now, float64(cfg.BytesPerMinute))
+		if wait := c.bytes.wait(1, float64(cfg.BytesPerMinute)); wait > 0 {
+			return &rateLimitedError{what: "上传字节数", wait: wait}
+		}
+	}
+	if cfg.RequestsPerMinute > 0 {
+		c.requests.refill(now, float64(cfg.RequestsPerMinute))
+		if wait := c.requests.wait(1, float64(cfg.RequestsPerMinute)); wait > 0 {
+			return &rateLimitedError{what: "请求数", wait: wait}
+		}
+		c.requests.tokens--
+	}
+	return nil
+}
+
+// addFile 扣除一个文件令牌，不足时返回错误
+func (c *clientLimit) addFile() error {
+	if c == nil || c.l.cfg.FilesPerMinute <= 0 {
+		return nil
+	}
+	perMinute := float64(c.l.cfg.FilesPerMinute)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen = now
+	c.files.refill(now, perMinute)
+	if wait := c.files.wait(1, perMinute); wait > 0 {
+		return types.NewError(types.CodeRateLimited, &rateLimitedError{what: "上传文件数", wait: wait})
+	}
+	c.files.tokens--
+	return nil
+}
+
+// reader 返回按读取字节数扣除令牌的 Reader
+func (c *clientLimit) reader(r io.Reader) io.Reader {
+	if c == nil || c.l.cfg.BytesPerMinute <= 0 {
+		return r
+	}
+	return &rateReader{r: r, c: c}
+}
+
+type rateReader struct {
+	r io.Reader
+	c *clientLimit
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		now := time.Now()
+		rr.c.mu.Lock()
+		rr.c.bytes.refill(now, float64(rr.c.l.cfg.BytesPerMinute))
+		rr.c.bytes.tokens -= float64(n)
+		rr.c.seen = now
+		rr.c.mu.Unlock()
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/pkg/types"
+)
+
+func newTestLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	return &rateLimiter{cfg: cfg, clients: make(map[string]*clientLimit)}
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		b          bucket
+		elapsed    time.Duration
+		wantTokens float64
+		wantWait   time.Duration // 需要 1 个令牌时的等待时间
+	}{
+		{name: "新建时为满", b: bucket{}, wantTokens: 60},
+		{name: "按时间补充", b: bucket{tokens: 0, last: now.Add(-30 * time.Second)}, wantTokens: 30},
+		{name: "不超过容量", b: bucket{tokens: 50, last: now.Add(-time.Hour)}, wantTokens: 60},
+		{name: "余额为零", b: bucket{tokens: 0, last: now}, wantTokens: 0, wantWait: time.Second},
+		{name: "欠额需要更久补足", b: bucket{tokens: -120, last: now.Add(-time.Minute)}, wantTokens: -60, wantWait: 61 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.b
+			b.refill(now, 60)
+			if b.tokens != tt.wantTokens {
+				t.Errorf("tokens = %v, want %v", b.tokens, tt.wantTokens)
+			}
+			if got := b.wait(1, 60); got != tt.wantWait {
+				t.Errorf("wait() = %v, want %v", got, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.RateLimitConfig
+		bytes    float64 // 预先设置的字节余额
+		requests int
+		allowed  int
+		what     string
+	}{
+		{name: "请求数用完后拒绝", cfg: config.RateLimitConfig{RequestsPerMinute: 2}, requests: 3, allowed: 2, what: "请求数"},
+		{name: "字节余额为负时拒绝", cfg: config.RateLimitConfig{RequestsPerMinute: 10, BytesPerMinute: 100}, bytes: -50, requests: 1, allowed: 0, what: "上传字节数"},
+		{name: "字节余额为正时放行", cfg: config.RateLimitConfig{BytesPerMinute: 100}, bytes: 10, requests: 3, allowed: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestLimiter(tt.cfg).client("192.0.2.1")
+			if tt.bytes != 0 {
+				c.bytes = bucket{tokens: tt.bytes, last: time.Now()}
+			}
+			allowed := 0
+			var last *rateLimitedError
+			for range tt.requests {
+				if err := c.allowRequest(); err != nil {
+					last = err
+					continue
+				}
+				allowed++
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d requests, want %d", allowed, tt.allowed)
+			}
+			if tt.what != "" && (last == nil || last.what != tt.what || last.wait <= 0) {
+				t.Errorf("last error = %+v, want %s with wait", last, tt.what)
+			}
+		})
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	c := newTestLimiter(config.RateLimitConfig{FilesPerMinute: 2}).client("192.0.2.1")
+	for i := range 2 {
+		if err := c.addFile(); err != nil {
+			t.Fatalf("addFile #%d: %v", i, err)
+		}
+	}
+	err := c.addFile()
+	var limited *rateLimitedError
+	if types.ErrorCode(err) != types.CodeRateLimited || !errors.As(err, &limited) {
+		t.Fatalf("addFile = %v, want rate_limited", err)
+	}
+	if (*clientLimit)(nil).addFile() != nil {
+		t.Error("nil clientLimit should not limit")
+	}
+}
+
+func TestRateReader(t *testing.T) {
+	c := newTestLimiter(config.RateLimitConfig{BytesPerMinute: 100}).client("192.0.2.1")
+	data := strings.Repeat("x", 250)
+	got, err := io.ReadAll(c.reader(strings.NewReader(data)))
+	if err != nil || string(got) != data {
+		t.Fatalf("ReadAll = %d bytes, %v", len(got), err)
+	}
+	// 读取不受限制，但余额变为负数，之后的请求需等待欠额补足
+	if c.bytes.tokens > -149 {
+		t.Errorf("tokens = %v, want about -150", c.bytes.tokens)
+	}
+	err2 := c.allowRequest()
+	if err2 == nil || err2.wait < 90*time.Second {
+		t.Errorf("allowRequest = %+v, want wait of about 91s", err2)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	cfg := config.RateLimitConfig{RequestsPerMinute: 10, BytesPerMinute: 100}
+	now := time.Now()
+	tests := []struct {
+		name  string
+		seen  time.Duration // 最后一次活动距 now 的时间
+		bytes float64       // 最后一次活动时的字节余额
+		kept  bool
+	}{
+		{name: "空闲且已补满", seen: 6 * time.Minute, bytes: 100, kept: false},
+		{name: "最近有活动", seen: time.Minute, bytes: 100, kept: true},
+		{name: "欠额尚未补足", seen: 6 * time.Minute, bytes: -1000, kept: true},
+		{name: "欠额已补足", seen: 12 * time.Minute, bytes: -1000, kept: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter(cfg)
+			c := l.client("192.0.2.1")
+			last := now.Add(-tt.seen)
+			c.seen = last
+			c.requests = bucket{tokens: 0, last: last}
+			c.bytes = bucket{tokens: tt.bytes, last: last}
+
+			l.sweep(now)
+			if _, ok := l.clients["192.0.2.1"]; ok != tt.kept {
+				t.Errorf("kept = %t, want %t", ok, tt.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"kgm2flac-backend/pkg/types"
+)
+
+// reportHeader 是单文件响应中携带结果清单的响应头
+const reportHeader = "X-Convert-Report"
+
+// writeReport 将结果清单以 manifest.json 与 report.txt 写入 zip
+func writeReport(zw *zip.Writer, results []types.ConvertResult) error {
+	rep := types.NewReport(results)
+
+	manifest, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeZipEntry(zw, "manifest.json", manifest); err != nil {
+		return err
+	}
+	return writeZipEntry(zw, "report.txt", []byte(formatReport(rep)))
+}
+
+// writeZipEntry 压缩后以已知的 CRC32 与大小写入，与音频条目一样不使用数据描述符
+func writeZipEntry(zw *zip.Writer, name string, data []byte) error {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	fh := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(buf.Len()),
+		UncompressedSize64: uint64(len(data)),
+	}
+	// CreateRaw 不会由 Modified 换算 MS-DOS 时间字段，与 zip.FileInfoHeader 一样用 SetModTime 同时设置
+	fh.SetModTime(time.Now())
+	w, err := createRaw(zw, fh)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// formatReport 生成便于阅读的文本报告，每个文件一行
+func formatReport(rep types.Report) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "共 %d 个文件，成功 %d 个，失败 %d 个\r\n\r\n", rep.Total, rep.Success, rep.Failed)
+	for _, f := range rep.Files {
+		dur := time.Duration(f.DurationMs) * time.Millisecond
+		if f.Error != "" {
+			fmt.Fprintf(&b, "[失败] %s: %s\r\n", f.Name, f.Error)
+			for _, line := range strings.Split(f.Detail, "\n") {
+				if line != "" {
+					fmt.Fprintf(&b, "    %s\r\n", line)
+				}
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "[成功] %s -> %s (加密=%s 源格式=%s 处理=%s 耗时=%s)\r\n",
+			f.Name, f.Output, f.Cipher, f.SourceFormat, f.Action, dur)
+	}
+	return b.String()
+}
+
+// maxReportHeaderBytes 限制 X-Convert-Report 的长度，常见代理默认只接受 4–8KB 的响应头
+const maxReportHeaderBytes = 4 << 10
+
+// headerReport 是响应头中的结果清单，超出长度时 files 只保留前若干个文件
+type headerReport struct {
+	types.Report
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// reportHeaderValue 将结果清单编码为 JSON，非 ASCII 字符转义为 \uXXXX，
+// 保证响应头只包含 ASCII 且可直接按 JSON 解析。诊断输出较长，不放入响应头；
+// 超过 maxReportHeaderBytes 时从末尾依次去掉文件并标记 truncated，统计数字保持完整
+func reportHeaderValue(results []types.ConvertResult) (string, error) {
+	rep := headerReport{Report: types.NewReport(results)}
+	for i := range rep.Files {
+		rep.Files[i].Detail = ""
+	}
+	for {
+		v, err := asciiJSON(rep)
+		if err != nil || len(v) <= maxReportHeaderBytes || len(rep.Files) == 0 {
+			return v, err
+		}
+		rep.Files = rep.Files[:len(rep.Files)-1]
+		rep.Truncated = true
+	}
+}
+
+// asciiJSON 将 v 编码为只包含 ASCII 的 JSON
+func asciiJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < 0x80 {
+			b.WriteRune(r)
+			continue
+		}
+		for _, u := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&b, `\u%04x`, u)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+var errShuttingDown = types.NewError(types.CodeShuttingDown, errors.New("服务正在关闭，请稍后重试"))
+
+// instancePrefix 是每个服务实例在系统临时目录下的父目录前缀，后接进程号，
+// 本实例的所有工作目录都创建在其中，退出时整体删除
+const instancePrefix = "kgm2flac_"
+
+// legacyPatterns 是旧版本直接在系统临时目录下创建的工作目录与中间文件，
+// 无法判断归属，只清理超过 legacyTempAge 未修改的
+var legacyPatterns = []string{"kgm2flac_*", "kgm_*.bin"}
+
+const legacyTempAge = 24 * time.Hour
+
+// newInstanceTempDir 创建本实例的临时父目录 kgm2flac_<pid>_*
+func newInstanceTempDir() (string, error) {
+	return os.MkdirTemp("", fmt.Sprintf("%s%d_*", instancePrefix, os.Getpid()))
+}
+
+// instancePID 从实例父目录名中取出进程号，不是实例目录时返回 false
+func instancePID(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, instancePrefix)
+	if !ok {
+		return 0, false
+	}
+	pidStr, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(pidStr)
+	return pid, err == nil && pid > 0
+}
+
+// rejectIfDraining 在关闭过程中拒绝新的上传，返回 true 表示已写入响应
+func (h *ConvertHandler) rejectIfDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !h.draining.Load() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", "5")
+	writeError(w, r, http.StatusServiceUnavailable, errShuttingDown)
+	return true
+}
+
+// Shutdown 停止接收新上传，等待进行中的请求与后台任务在 timeout 内完成，
+// 超时后取消剩余转换（exec.CommandContext 随之终止 ffmpeg），最后清理临时文件
+func (h *ConvertHandler) Shutdown(srv *http.Server, timeout time.Duration) {
+	h.draining.Store(true)
+	// 进度推送是长连接，不断开的话 srv.Shutdown 会一直等到超时
+	close(h.streamsDone)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown 关闭监听并等待进行中的请求；超时后 Close 断开连接，请求上下文被取消
+	if err := srv.Shutdown(ctx); err != nil {
+		zap.L().Warn("等待请求完成超时，强制断开连接", zap.Error(err))
+		_ = srv.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		zap.L().Warn("等待后台任务超时，终止剩余转换", zap.Int("ffmpeg", h.converter.RunningFFmpeg()))
+		h.cancel()
+		<-done
+	}
+	h.cancel()
+
+	h.jobs.removeAll()
+	if err := os.RemoveAll(h.tempDir); err != nil {
+		zap.L().Warn("remove temp dir failed", zap.String("path", h.tempDir), zap.Error(err))
+	}
+}
+
+// sweepTempFiles 删除系统临时目录下其他实例异常退出后遗留的文件，返回删除的数量。
+// 同一主机上可能同时运行多个实例（如滚动发布），只删除进程已退出、
+// 且超过关闭等待时间未修改的实例目录；cache_dir 与 upload_dir 无论名字如何都不删除
+func (h *ConvertHandler) sweepTempFiles() int {
+	keep := map[string]bool{filepath.Clean(h.tempDir): true}
+	for _, dir := range []string{h.cfg.CacheDir, h.cfg.UploadDir} {
+		if dir != "" {
+			if abs, err := filepath.Abs(dir); err == nil {
+				keep[abs] = true
+			}
+		}
+	}
+	staleAfter := max(h.cfg.ShutdownTimeout, time.Minute)
+
+	n := 0
+	seen := make(map[string]bool)
+	for _, pattern := range legacyPatterns {
+		matches, err := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		if err != nil {
+			continue
+		}
+		for _, path := range matches {
+			if seen[path] || keep[filepath.Clean(path)] {
+				continue
+			}
+			seen[path] = true
+			info, err := os.Lstat(path)
+			if err != nil {
+				continue
+			}
+			age := time.Since(info.ModTime())
+			if pid, ok := instancePID(filepath.Base(path)); ok && info.IsDir() {
+				if pid == os.Getpid() || utils.ProcessAlive(pid) || age < staleAfter {
+					continue
+				}
+			} else if age < legacyTempAge {
+				continue
+			}
+			if err := os.RemoveAll(path); err != nil {
+				zap.L().Warn("remove temp failed", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			n++
+		}
+	}
+	return n
+}
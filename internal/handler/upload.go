@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+)
+
+var errFileTooLarge = errors.New("文件超过单文件限制")
+
+// sizeLimitReader 统计已读取的字节数，超过 max 时返回 errFileTooLarge
+type sizeLimitReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, fmt.Errorf("%w (%d bytes)", errFileTooLarge, l.max)
+	}
+	return n, err
+}
+
+// readUploads 以流的方式遍历 multipart 请求体，不在内存或磁盘上缓存整个表单。
+// 选项字段（format、strip_metadata）必须位于文件之前；每个 files 字段交给 onFile 处理，
+// 单个文件的处理失败应记录在结果中，onFile 返回错误或超出每日字节配额会中止整个请求
+func (h *ConvertHandler) readUploads(w http.ResponseWriter, r *http.Request, opts *convertOptions, onFile func(name string, body io.Reader) error) (int, error) {
+	// 限制整个请求体最大值
+	limit := int64(h.cfg.MaxFiles)*h.cfg.MaxFileSize + (10 << 20) // +10MiB
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return 0, types.NewError(types.CodeBadRequest, fmt.Errorf("表单解析失败: %w", err))
+	}
+
+	lease := leaseFromContext(r.Context())
+	rate := rateFromContext(r.Context())
+	count := 0
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return count, formError(err)
+		}
+
+		field := part.FormName()
+		if field == "files" {
+			if part.FileName() == "" {
+				part.Close()
+				continue
+			}
+			count++
+			if count > h.cfg.MaxFiles {
+				part.Close()
+				return count, types.NewError(types.CodeTooManyFiles, fmt.Errorf("最多上传 %d 个文件", h.cfg.MaxFiles))
+			}
+			if err := rate.addFile(); err != nil {
+				part.Close()
+				return count, err
+			}
+			if err := lease.addFile(); err != nil {
+				part.Close()
+				return count, err
+			}
+			body := lease.reader(rate.reader(part))
+			err := onFile(part.FileName(), body)
+			part.Close()
+			if err == nil {
+				err = quotaError(body)
+			}
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+
+		if !isOptionField(field) {
+			part.Close()
+			continue
+		}
+		if count > 0 {
+			part.Close()
+			return count, types.NewError(types.CodeBadRequest, fmt.Errorf("选项字段 %s 必须位于文件之前", field))
+		}
+		value, err := io.ReadAll(io.LimitReader(part, 1024))
+		part.Close()
+		if err != nil {
+			return count, formError(err)
+		}
+		if err := opts.apply(field, string(value)); err != nil {
+			return count, err
+		}
+	}
+
+	if count == 0 {
+		return 0, types.NewError(types.CodeNoFiles, errors.New("未选择文件（字段名为 files）"))
+	}
+	return count, nil
+}
+
+// formError 为读取请求体时的错误附加错误码
+func formError(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return types.NewError(types.CodeRequestTooLarge, fmt.Errorf("请求体超过 %d 字节限制", maxBytes.Limit))
+	}
+	return types.NewError(types.CodeBadRequest, fmt.Errorf("表单解析失败: %w", err))
+}
+
+// outputStem 返回上传文件对应的输出文件名主干（已规范化，不含扩展名），
+// 同一批次内还需经 NameSet 去重
+func outputStem(name string) string {
+	return utils.ReplaceExt(utils.SanitizeFilename(name), "")
+}
+
+func isOptionField(field string) bool {
+	for _, f := range optionFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
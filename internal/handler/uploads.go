@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/internal/service"
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+// tus 1.0.0 可续传上传协议：https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,expiration,termination"
+	tusOctets     = "application/offset+octet-stream"
+)
+
+var errUploadNotFound = types.NewError(types.CodeNotFound, service.ErrUploadNotFound)
+
+// tus 为可续传上传的响应附加 Tus-Resumable，并拒绝协议版本不符的请求
+func tus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeError(w, r, http.StatusPreconditionFailed, types.NewError(types.CodeBadRequest, fmt.Errorf("不支持的 Tus-Resumable 版本 %q，仅支持 %s", v, tusVersion)))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleUploadOptions 返回服务端支持的 tus 版本、扩展与单文件大小上限，无需认证
+func (h *ConvertHandler) HandleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.cfg.MaxFileSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUploadCreate 新建上传。Upload-Length 为文件大小，Upload-Metadata 中的 filename 为原始文件名；
+// 请求体类型为 application/offset+octet-stream 时同时写入第一段数据
+func (h *ConvertHandler) HandleUploadCreate(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	if h.rejectIfDraining(w, r) {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeBadRequest, errors.New("不支持 Upload-Defer-Length，请提供 Upload-Length")))
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeBadRequest, errors.New("缺少或无效的 Upload-Length")))
+		return
+	}
+	if length > h.cfg.MaxFileSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, types.NewError(types.CodeFileTooLarge, fmt.Errorf("%w (%d bytes)", errFileTooLarge, h.cfg.MaxFileSize)))
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeBadRequest, err))
+		return
+	}
+	name := uploadFilename(meta)
+	if name == "" {
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeBadRequest, errors.New("Upload-Metadata 中缺少 filename")))
+		return
+	}
+	if !service.IsSupportedExt(filepath.Ext(name)) {
+		writeError(w, r, http.StatusUnsupportedMediaType, types.NewError(types.CodeUnsupportedCipher, fmt.Errorf("%w: %s", service.ErrUnknownCipher, name)))
+		return
+	}
+
+	// 文件数在创建时计入配额与限流，字节数在写入时计入
+	lease := leaseFromContext(r.Context())
+	if err := rateFromContext(r.Context()).addFile(); err != nil {
+		writeUploadError(w, r, err)
+		return
+	}
+	if err := lease.addFile(); err != nil {
+		writeUploadError(w, r, err)
+		return
+	}
+
+	u, err := h.uploads.Create(length, meta, lease.name())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("创建上传失败: %w", err))
+		logger.Error("create upload failed", zap.Error(err))
+		return
+	}
+	logger.Info("upload created", zap.String("upload_id", u.ID), zap.String("name", name), zap.Int64("length", length))
+
+	w.Header().Set("Location", "/api/uploads/"+u.ID)
+	if contentType(r) == tusOctets {
+		if u, err = h.appendUpload(r, u.ID, 0); err != nil {
+			h.writeAppendError(w, r, u, err)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	}
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleUploadHead 返回已接收的字节数，客户端据此从断点继续
+func (h *ConvertHandler) HandleUploadHead(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if len(u.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatUploadMetadata(u.Metadata))
+	}
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleUploadPatch 从 Upload-Offset 处追加数据，连接中断时已写入的部分保留
+func (h *ConvertHandler) HandleUploadPatch(w http.ResponseWriter, r *http.Request) {
+	if contentType(r) != tusOctets {
+		writeError(w, r, http.StatusUnsupportedMediaType, types.NewError(types.CodeBadRequest, fmt.Errorf("Content-Type 必须为 %s", tusOctets)))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeBadRequest, errors.New("缺少或无效的 Upload-Offset")))
+		return
+	}
+	if _, ok := h.ownUpload(w, r); !ok {
+		return
+	}
+
+	u, err := h.appendUpload(r, r.PathValue("id"), offset)
+	if err != nil {
+		h.writeAppendError(w, r, u, err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUploadDelete 放弃上传并删除已接收的数据
+func (h *ConvertHandler) HandleUploadDelete(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	if err := h.uploads.Delete(u.ID); err != nil {
+		h.writeAppendError(w, r, nil, err)
+		return
+	}
+	logging.FromContext(r.Context()).Info("upload deleted", zap.String("upload_id", u.ID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownUpload 返回路径中的上传。其他密钥创建的上传同样视为不存在，返回 false 表示已写入响应
+func (h *ConvertHandler) ownUpload(w http.ResponseWriter, r *http.Request) (*service.Upload, bool) {
+	u, err := h.uploads.Get(r.PathValue("id"))
+	if err == nil && u.Owner != leaseFromContext(r.Context()).name() {
+		err = service.ErrUploadNotFound
+	}
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		writeError(w, r, http.StatusNotFound, errUploadNotFound)
+		return nil, false
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, err)
+		logging.FromContext(r.Context()).Error("read upload failed", zap.Error(err))
+		return nil, false
+	}
+	return u, true
+}
+
+// appendUpload 写入请求体，字节数计入配额与限流
+func (h *ConvertHandler) appendUpload(r *http.Request, id string, offset int64) (*service.Upload, error) {
+	body := leaseFromContext(r.Context()).reader(rateFromContext(r.Context()).reader(r.Body))
+	u, err := h.uploads.Append(id, offset, r.ContentLength, body)
+	if u != nil {
+		logging.FromContext(r.Context()).Debug("upload chunk",
+			zap.String("upload_id", id),
+			zap.Int64("offset", u.Offset),
+			zap.Int64("length", u.Length),
+			zap.Error(err))
+	}
+	return u, err
+}
+
+// writeAppendError 返回写入失败的原因；u 不为 nil 时附带实际偏移，客户端可据此续传
+func (h *ConvertHandler) writeAppendError(w http.ResponseWriter, r *http.Request, u *service.Upload, err error) {
+	if u != nil {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	}
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		writeError(w, r, http.StatusNotFound, errUploadNotFound)
+	case errors.Is(err, service.ErrOffsetMismatch), errors.Is(err, service.ErrUploadLocked):
+		writeError(w, r, http.StatusConflict, types.NewError(types.CodeOffsetMismatch, err))
+	case errors.Is(err, service.ErrUploadTooLong):
+		writeError(w, r, http.StatusRequestEntityTooLarge, types.NewError(types.CodeRequestTooLarge, err))
+	case types.ErrorCode(err) == types.CodeInternal:
+		// 多为客户端断开，已写入的数据保留
+		writeError(w, r, http.StatusBadRequest, types.NewError(types.CodeUploadFailed, fmt.Errorf("接收上传数据失败: %w", err)))
+		logging.FromContext(r.Context()).Warn("upload chunk failed", zap.Error(err))
+	default:
+		writeUploadError(w, r, err)
+	}
+}
+
+// uploadJobRequest 是以 JSON 创建任务的请求体，uploads 为已完成的上传 ID
+type uploadJobRequest struct {
+	Uploads       []string `json:"uploads"`
+	Format        *string  `json:"format"`
+	StripMetadata *bool    `json:"strip_metadata"`
+}
+
+// takeUploads 读取 JSON 请求体，将已完成的上传移入任务目录作为输入文件。
+// 所有上传都校验通过后才开始移动，任何一个不存在或未完成都不会消耗其他上传
+func (h *ConvertHandler) takeUploads(r *http.Request, j *job, opts *convertOptions) error {
+	if h.uploads == nil {
+		return types.NewError(types.CodeBadRequest, errors.New("未启用可续传上传，请使用 multipart/form-data 上传文件"))
+	}
+	var req uploadJobRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return types.NewError(types.CodeBadRequest, fmt.Errorf("请求体解析失败: %w", err))
+	}
+	if req.Format != nil {
+		if err := opts.apply("format", *req.Format); err != nil {
+			return err
+		}
+	}
+	if req.StripMetadata != nil {
+		opts.StripMetadata = *req.StripMetadata
+	}
+
+	switch {
+	case len(req.Uploads) == 0:
+		return types.NewError(types.CodeNoFiles, errors.New("未指定上传"))
+	case len(req.Uploads) > h.cfg.MaxFiles:
+		return types.NewError(types.CodeTooManyFiles, fmt.Errorf("最多上传 %d 个文件", h.cfg.MaxFiles))
+	}
+
+	owner := leaseFromContext(r.Context()).name()
+	seen := make(map[string]bool, len(req.Uploads))
+	uploads := make([]*service.Upload, 0, len(req.Uploads))
+	for _, id := range req.Uploads {
+		if seen[id] {
+			return types.NewError(types.CodeBadRequest, fmt.Errorf("上传 %s 重复", id))
+		}
+		seen[id] = true
+		u, err := h.uploads.Get(id)
+		if err == nil && u.Owner != owner {
+			err = service.ErrUploadNotFound
+		}
+		switch {
+		case errors.Is(err, service.ErrUploadNotFound):
+			return types.NewError(types.CodeNotFound, fmt.Errorf("%w: %s", service.ErrUploadNotFound, id))
+		case err != nil:
+			return err
+		case !u.Complete():
+			return types.NewError(types.CodeUploadIncomplete, fmt.Errorf("%w: %s（%d/%d bytes）", service.ErrUploadIncomplete, id, u.Offset, u.Length))
+		}
+		uploads = append(uploads, u)
+	}
+
+	names := utils.NewNameSet()
+	for _, u := range uploads {
+		name := uploadFilename(u.Metadata)
+		res := types.ConvertResult{
+			OrigName: name,
+			Size:     u.Length,
+			Format:   opts.Format,
+			State:    types.StateQueued,
+		}
+		inPath := filepath.Join(j.workDir, fmt.Sprintf("kgm_%s%s", utils.RandHex(8), filepath.Ext(name)))
+		if err := h.uploads.Take(u.ID, inPath); err != nil {
+			// 校验之后被并发请求取走或删除，只影响这一个文件
+			j.logger.Error("take upload failed", zap.String("upload_id", u.ID), zap.Error(err))
+			res.Err = fileError(types.CodeUploadFailed, fmt.Errorf("读取上传 %s 失败: %w", u.ID, err))
+			res.State = types.StateFailed
+			h.metrics.fileFailed(types.StateQueued, res.Err)
+			inPath = ""
+		} else {
+			j.events.publish(types.EventReceived, types.FileEvent{Index: len(j.results), Name: name, Size: u.Length})
+		}
+		h.metrics.inputBytes.Observe(float64(u.Length))
+		j.inputs = append(j.inputs, inPath)
+		j.outBases = append(j.outBases, filepath.Join(j.workDir, names.Claim(outputStem(name))))
+		j.results = append(j.results, res)
+	}
+	return nil
+}
+
+// parseUploadMetadata 解析 Upload-Metadata：逗号分隔的 "key base64(value)"，值可以省略
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Upload-Metadata 格式错误")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata 中 %s 的值不是有效的 base64", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// formatUploadMetadata 按键排序编码 Upload-Metadata
+func formatUploadMetadata(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if meta[k] == "" {
+			pairs = append(pairs, k)
+			continue
+		}
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(meta[k])))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// uploadFilename 返回元数据中的文件名，兼容 tus-js-client 常用的 name 字段
+func uploadFilename(meta map[string]string) string {
+	if name := meta["filename"]; name != "" {
+		return name
+	}
+	return meta["name"]
+}
+
+// contentType 返回不含参数的请求 Content-Type
+func contentType(r *http.Request) string {
+	mt, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// 日志输出格式
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+type ctxKey struct{}
+
+// New 按输出格式（json/console）与级别（debug/info/warn/error）创建写到 stderr 的 logger
+func New(format, level string) (*zap.Logger, error) {
+	lvl := zapcore.InfoLevel
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("无效的日志级别 %q: %w", level, err)
+		}
+	}
+
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.TimeKey = "time"
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	encCfg.EncodeDuration = zapcore.StringDurationEncoder
+
+	var enc zapcore.Encoder
+	switch format {
+	case FormatJSON, "":
+		enc = zapcore.NewJSONEncoder(encCfg)
+	case FormatConsole:
+		encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	default:
+		return nil, fmt.Errorf("无效的日志格式 %q，可选: json, console", format)
+	}
+
+	core := zapcore.NewCore(enc, zapcore.Lock(os.Stderr), lvl)
+	return zap.New(core, zap.AddCaller(), zap.ErrorOutput(zapcore.Lock(os.Stderr))), nil
+}
+
+// WithContext 返回携带 logger 的 context，之后的处理通过 FromContext 取出
+func WithContext(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext 返回 ctx 中的 logger（带有请求 ID 等字段），没有时返回全局 logger
+func FromContext(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return zap.L()
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kgm2flac-backend/internal/utils"
+)
+
+// CachedResult 是缓存条目的描述，与输出文件一起保存为 <key>.json
+type CachedResult struct {
+	Ext          string `json:"ext"`
+	Cipher       string `json:"cipher"`
+	SourceFormat string `json:"source_format"`
+	Action       string `json:"action"`
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+	meta CachedResult
+}
+
+// ResultCache 是以加密文件内容哈希为键的转换结果磁盘缓存，总大小超过上限时按最近使用淘汰
+type ResultCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // 前端为最近使用
+	size    int64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// NewResultCache 打开 dir 下的缓存，已有条目按文件修改时间恢复使用顺序
+func NewResultCache(dir string, maxBytes int64) (*ResultCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &ResultCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// CacheKey 由加密文件的 SHA-256、原始文件名、输出选项与编码配置生成缓存键。
+// 源文件没有标签时会从文件名补全标签，因此文件名也影响输出
+func (c *Converter) CacheKey(sum []byte, name string, opts Options) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%x\n%s\n%s\n%t\n%s", sum, name, opts.Format, opts.StripMetadata, c.configSum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *ResultCache) load() error {
+	metas, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		entry *cacheEntry
+		mod   time.Time
+	}
+	var all []loaded
+	for _, mp := range metas {
+		key := strings.TrimSuffix(filepath.Base(mp), ".json")
+		data, err := os.ReadFile(mp)
+		if err != nil {
+			continue
+		}
+		var meta CachedResult
+		if err := json.Unmarshal(data, &meta); err != nil {
+			_ = os.Remove(mp)
+			continue
+		}
+		fi, err := os.Stat(c.dataPath(key, meta.Ext))
+		if err != nil {
+			_ = os.Remove(mp)
+			continue
+		}
+		all = append(all, loaded{&cacheEntry{key: key, size: fi.Size(), meta: meta}, fi.ModTime()})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].mod.After(all[j].mod) })
+	for _, l := range all {
+		c.entries[l.entry.key] = c.lru.PushBack(l.entry)
+		c.size += l.entry.size
+	}
+	return nil
+}
+
+func (c *ResultCache) dataPath(key, ext string) string {
+	return filepath.Join(c.dir, key+ext)
+}
+
+// Get 命中时将缓存的输出链接（或复制）为 dstBase 加输出扩展名，返回条目描述与输出路径
+func (c *ResultCache) Get(key, dstBase string) (*CachedResult, string, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, "", false
+	}
+
+	e := el.Value.(*cacheEntry)
+	src := c.dataPath(key, e.meta.Ext)
+	dst := dstBase + e.meta.Ext
+	if err := linkOrCopy(src, dst); err != nil {
+		// 缓存文件被外部删除等情况，视为未命中
+		c.remove(el)
+		c.misses.Add(1)
+		return nil, "", false
+	}
+	now := time.Now()
+	_ = os.Chtimes(src, now, now)
+	c.hits.Add(1)
+	meta := e.meta
+	return &meta, dst, true
+}
+
+// Put 将输出文件加入缓存，超出容量时淘汰最久未使用的条目
+func (c *ResultCache) Put(key, path string, meta CachedResult) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > c.maxBytes {
+		return nil
+	}
+
+	tmp := filepath.Join(c.dir, ".tmp_"+utils.RandHex(8))
+	if err := linkOrCopy(path, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.dataPath(key, meta.Ext)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	// path 已是缓存文件的硬链接时 Rename 不做任何事，临时链接仍然存在
+	_ = os.Remove(tmp)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, key+".json"), data, 0o644); err != nil {
+		_ = os.Remove(c.dataPath(key, meta.Ext))
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: fi.Size(), meta: meta})
+	c.size += fi.Size()
+	c.evict()
+	return nil
+}
+
+// Stats 返回命中与未命中次数
+func (c *ResultCache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// Size 返回缓存占用的字节数与条目数
+func (c *ResultCache) Size() (bytes int64, entries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, c.lru.Len()
+}
+
+// remove 删除条目 el。释放锁期间同一键可能已被 Put 替换，此时保留新条目
+func (c *ResultCache) remove(el *list.Element) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.entries[el.Value.(*cacheEntry).key]; ok && cur == el {
+		c.drop(el)
+	}
+}
+
+// evict 淘汰最久未使用的条目直到总大小不超过上限，调用方持有 mu
+func (c *ResultCache) evict() {
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.drop(el)
+	}
+}
+
+func (c *ResultCache) drop(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	_ = os.Remove(c.dataPath(e.key, e.meta.Ext))
+	_ = os.Remove(filepath.Join(c.dir, e.key+".json"))
+}
+
+// linkOrCopy 优先创建硬链接，跨设备时复制
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeOutput 在 dir 下写入 size 字节的输出文件
+func writeOutput(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, bytes.Repeat([]byte(name[:1]), size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cachedKeys 按最近使用顺序返回缓存中的键
+func cachedKeys(c *ResultCache) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*cacheEntry).key)
+	}
+	return keys
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	tests := []struct {
+		name     string
+		ops      []string // "put <key> <size>" 或 "get <key>"
+		want     []string // 最近使用在前
+		wantSize int64
+	}{
+		{name: "未超出上限", ops: []string{"put a 10", "put b 10"}, want: []string{"b", "a"}, wantSize: 20},
+		{name: "淘汰最久未使用", ops: []string{"put a 10", "put b 10", "put c 10"}, want: []string{"c", "b"}, wantSize: 20},
+		{name: "Get 刷新使用顺序", ops: []string{"put a 10", "put b 10", "get a", "put c 10"}, want: []string{"c", "a"}, wantSize: 20},
+		{name: "一次淘汰多个条目", ops: []string{"put a 10", "put b 10", "put c 20"}, want: []string{"c"}, wantSize: 20},
+		{name: "超过上限的文件不缓存", ops: []string{"put a 10", "put b 30"}, want: []string{"a"}, wantSize: 10},
+		{name: "替换同一键", ops: []string{"put a 10", "put b 10", "put a 5"}, want: []string{"a", "b"}, wantSize: 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, work := t.TempDir(), t.TempDir()
+			c, err := NewResultCache(dir, 25)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, op := range tt.ops {
+				f := strings.Fields(op)
+				switch f[0] {
+				case "put":
+					size, _ := strconv.Atoi(f[2])
+					path := writeOutput(t, work, f[1]+".out", size)
+					if err := c.Put(f[1], path, CachedResult{Ext: ".flac"}); err != nil {
+						t.Fatalf("op %d: Put: %v", i, err)
+					}
+				case "get":
+					if _, _, ok := c.Get(f[1], filepath.Join(work, "got")); !ok {
+						t.Fatalf("op %d: Get(%q) missed", i, f[1])
+					}
+				}
+			}
+
+			if got := cachedKeys(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys = %v, want %v", got, tt.want)
+			}
+			if size, n := c.Size(); size != tt.wantSize || n != len(tt.want) {
+				t.Errorf("Size() = %d, %d, want %d, %d", size, n, tt.wantSize, len(tt.want))
+			}
+			// 被淘汰的条目连同描述文件一起删除
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			if len(files) != 2*len(tt.want) {
+				t.Errorf("cache dir has %d files, want %d", len(files), 2*len(tt.want))
+			}
+		})
+	}
+}
+
+func TestResultCacheReload(t *testing.T) {
+	dir, work := t.TempDir(), t.TempDir()
+	c, err := NewResultCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按修改时间恢复顺序：b 最近，a 最久
+	now := time.Now()
+	for i, key := range []string{"a", "c", "b"} {
+		if err := c.Put(key, writeOutput(t, work, key+".out", 10), CachedResult{Ext: ".mp3", Cipher: "kgm"}); err != nil {
+			t.Fatal(err)
+		}
+		mod := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, key+".mp3"), mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 描述文件损坏或数据文件缺失的条目在加载时清理
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "orphan.json"), []byte(`{"ext":".mp3"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		maxBytes int64
+		want     []string
+	}{
+		{name: "恢复全部条目", maxBytes: 100, want: []string{"b", "c", "a"}},
+		{name: "上限变小时淘汰最久未使用", maxBytes: 20, want: []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewResultCache(dir, tt.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cachedKeys(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys = %v, want %v", got, tt.want)
+			}
+			if size, n := c.Size(); size != int64(10*len(tt.want)) || n != len(tt.want) {
+				t.Errorf("Size() = %d, %d, want %d, %d", size, n, 10*len(tt.want), len(tt.want))
+			}
+			meta, path, ok := c.Get("b", filepath.Join(t.TempDir(), "out"))
+			if !ok || meta.Cipher != "kgm" || filepath.Ext(path) != ".mp3" {
+				t.Errorf("Get(b) = %+v, %q, %t", meta, path, ok)
+			}
+			for _, name := range []string{"bad.json", "orphan.json"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s was not removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestResultCacheGetMissingFile(t *testing.T) {
+	dir, work := t.TempDir(), t.TempDir()
+	c, err := NewResultCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("a", writeOutput(t, work, "a.out", 10), CachedResult{Ext: ".flac"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "a.flac")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := c.Get("a", filepath.Join(work, "got")); ok {
+		t.Fatal("Get hit after the cached file was removed")
+	}
+	if size, n := c.Size(); size != 0 || n != 0 {
+		t.Errorf("Size() = %d, %d, want 0, 0", size, n)
+	}
+	if hits, misses := c.Stats(); hits != 0 || misses != 1 {
+		t.Errorf("Stats() = %d, %d, want 0, 1", hits, misses)
+	}
+}
+
+func TestResultCacheRemoveReplaced(t *testing.T) {
+	dir, work := t.TempDir(), t.TempDir()
+	c, err := NewResultCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("a", writeOutput(t, work, "a.out", 10), CachedResult{Ext: ".flac"}); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	old := c.entries["a"]
+	c.mu.Unlock()
+
+	// 模拟 Get 释放锁后链接失败，期间 Put 已替换了同一键
+	if err := c.Put("a", writeOutput(t, work, "b.out", 20), CachedResult{Ext: ".flac"}); err != nil {
+		t.Fatal(err)
+	}
+	c.remove(old)
+
+	if size, n := c.Size(); size != 20 || n != 1 {
+		t.Errorf("Size() = %d, %d, want 20, 1", size, n)
+	}
+	if _, path, ok := c.Get("a", filepath.Join(work, "got")); !ok {
+		t.Error("replaced entry was removed")
+	} else if data, _ := os.ReadFile(path); len(data) != 20 {
+		t.Errorf("got %d bytes, want 20", len(data))
+	}
+}
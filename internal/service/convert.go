@@ -0,0 +1,364 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+// Converter 将解密后的音频处理为最终输出：嗅探源格式、原样输出或调用 ffmpeg 转码，并写入标签。
+// HTTP 接口与命令行批量转换共用
+type Converter struct {
+	Decrypt   *DecryptService
+	ffmpegBin string
+	encoders  map[string][]string
+	ffmpeg    utils.Semaphore // 全局 ffmpeg 进程数限制
+	filenames *FilenameParser
+	configSum string // 影响输出的配置摘要，参与缓存键
+}
+
+// Options 是单次转换的选项
+type Options struct {
+	Format        string // 输出格式或模式（auto/passthrough）
+	StripMetadata bool   // 清除标签与封面
+}
+
+// Output 描述一次转换的产物
+type Output struct {
+	Path         string
+	Format       OutputFormat
+	SourceFormat string        // 嗅探到的源格式，如 flac
+	Action       string        // passthrough 或 transcode
+	TagErr       error         // 标签写入失败，不影响输出
+	Transcode    time.Duration // ffmpeg 转码耗时，原样输出时为 0
+}
+
+// Hooks 接收单个文件处理过程中的通知，字段均可为 nil
+type Hooks struct {
+	OnPlan     func(out *Output)     // 已识别源格式并确定输出格式与处理方式，尚未开始输出
+	OnProgress func(percent float64) // ffmpeg 转码进度（0–100），无法得到输入时长时不调用
+}
+
+func NewConverter(cfg *config.Config) (*Converter, error) {
+	filenames, err := NewFilenameParser(cfg.FilenamePatterns)
+	if err != nil {
+		return nil, err
+	}
+	return &Converter{
+		Decrypt:   NewDecryptService(),
+		ffmpegBin: cfg.FFmpegBin,
+		encoders:  cfg.Encoders,
+		ffmpeg:    utils.NewSemaphore(cfg.MaxFFmpeg),
+		filenames: filenames,
+		configSum: configDigest(cfg),
+	}, nil
+}
+
+// configDigest 汇总实际生效的编码参数与文件名解析规则，配置变化后旧的缓存结果不再命中
+func configDigest(cfg *config.Config) string {
+	h := sha256.New()
+	for _, name := range FormatNames() {
+		fmt.Fprintf(h, "%s=%q\n", name, outputFormats[name].EncoderArgs(cfg.Encoders[name]))
+	}
+	fmt.Fprintf(h, "patterns=%q\n", cfg.FilenamePatterns)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Finish 将解密结果写为 outBase 加输出扩展名的文件，origName 用于从文件名补全标签。
+// 处理过程通过 hooks 通知调用方。返回的错误带有错误码
+func (c *Converter) Finish(ctx context.Context, dr *DecryptResult, origName, outBase string, opts Options, hooks Hooks) (*Output, error) {
+	rawExt, err := SniffAudioExt(dr.Path)
+	if err != nil {
+		return nil, types.NewError(types.CodeSniffFailed, fmt.Errorf("识别音频格式失败: %w", err))
+	}
+
+	// 根据请求的格式或模式决定原样输出还是转码
+	format, action, err := PlanOutput(opts.Format, rawExt)
+	if err != nil {
+		return nil, types.NewError(types.CodeInvalidOption, err)
+	}
+	if opts.StripMetadata && action == ActionPassthrough && sourceFormats[rawExt].NoMux {
+		return nil, types.NewError(types.CodeInvalidOption, fmt.Errorf("原样输出的%s文件无法清除标签，请指定转码格式", strings.ToUpper(format.Name)))
+	}
+	out := &Output{
+		Path:         outBase + format.Ext,
+		Format:       format,
+		SourceFormat: strings.TrimPrefix(rawExt, "."),
+		Action:       action,
+	}
+	if hooks.OnPlan != nil {
+		hooks.OnPlan(out)
+	}
+
+	if action == ActionPassthrough && opts.StripMetadata && format.Ext != ".flac" {
+		// 其他容器的标签无法直接删除，以流复制的方式重新封装
+		if err := c.remux(ctx, dr.Path, out.Path, format); err != nil {
+			return out, types.NewError(types.CodeTranscodeFailed, fmt.Errorf("清除%s标签失败: %w", strings.ToUpper(format.Name), err))
+		}
+		_ = os.Remove(dr.Path)
+	} else if action == ActionPassthrough {
+		// 原样输出，直接重命名
+		if err := utils.MoveFile(dr.Path, out.Path); err != nil {
+			return out, types.NewError(types.CodeOutputFailed, fmt.Errorf("移动输出文件失败: %w", err))
+		}
+	} else {
+		// 需要转码为目标格式
+		start := time.Now()
+		if err := c.transcode(ctx, dr.Path, out.Path, format, opts.StripMetadata, hooks.OnProgress); err != nil {
+			return out, types.NewError(types.CodeTranscodeFailed, fmt.Errorf("转码为%s失败: %w", strings.ToUpper(format.Name), err))
+		}
+		out.Transcode = time.Since(start)
+		_ = os.Remove(dr.Path)
+	}
+
+	// FLAC 输出：按选项清除标签，或补写解码器提供的标签与封面，
+	// 源文件没有标签时再用文件名解析出的歌手、歌名
+	if format.Ext == ".flac" {
+		if opts.StripMetadata {
+			if action == ActionPassthrough {
+				out.TagErr = StripFlac(out.Path)
+			}
+		} else {
+			out.TagErr = TagFlac(out.Path, dr.Meta, c.filenames.Parse(origName))
+		}
+	}
+	return out, nil
+}
+
+// ConvertFile 解密并转换磁盘上的单个文件，输出为 outBase 加输出扩展名，必要时创建目录。
+// 中间文件写在 workDir，应与输出位于同一文件系统。标签写入失败不影响结果，通过 tagErr 返回
+func (c *Converter) ConvertFile(ctx context.Context, src, outBase, workDir string, opts Options) (res types.ConvertResult, tagErr error) {
+	start := time.Now()
+	name := filepath.Base(src)
+	res = types.ConvertResult{OrigName: name, Format: opts.Format, State: types.StateDecrypting}
+	fail := func(code string, err error) (types.ConvertResult, error) {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			code = types.CodeTimeout
+		case errors.Is(err, context.Canceled):
+			code = types.CodeCanceled
+		}
+		res.Err = types.NewError(code, err)
+		res.State = types.StateFailed
+		res.Duration = time.Since(start)
+		return res, nil
+	}
+
+	if fi, err := os.Stat(src); err == nil {
+		res.Size = fi.Size()
+	}
+
+	dr, cleanup, err := c.Decrypt.DecryptFile(ctx, src, name, workDir)
+	if err != nil {
+		code := types.CodeDecryptFailed
+		if errors.Is(err, ErrUnknownCipher) {
+			code = types.CodeUnsupportedCipher
+		}
+		return fail(code, fmt.Errorf("解密失败: %w", err))
+	}
+	defer cleanup()
+	res.Cipher = dr.Cipher
+
+	out, err := c.Finish(ctx, dr, name, filepath.Join(workDir, utils.RandHex(8)), opts, Hooks{})
+	if out != nil {
+		res.SourceFormat = out.SourceFormat
+		res.Action = out.Action
+	}
+	if err != nil {
+		return fail(types.ErrorCode(err), err)
+	}
+
+	final := outBase + out.Format.Ext
+	if err := os.MkdirAll(filepath.Dir(final), 0o755); err != nil {
+		_ = os.Remove(out.Path)
+		return fail(types.CodeOutputFailed, err)
+	}
+	if err := os.Rename(out.Path, final); err != nil {
+		_ = os.Remove(out.Path)
+		return fail(types.CodeOutputFailed, fmt.Errorf("移动输出文件失败: %w", err))
+	}
+
+	res.OutPath = final
+	res.State = types.StateDone
+	res.Duration = time.Since(start)
+	return res, out.TagErr
+}
+
+// ExistingOutput 返回 outBase 按 choice 转换后已存在的输出文件，不存在时返回空字符串
+func ExistingOutput(outBase, choice string) string {
+	for _, ext := range OutputExts(choice) {
+		if _, err := os.Stat(outBase + ext); err == nil {
+			return outBase + ext
+		}
+	}
+	return ""
+}
+
+// RunningFFmpeg 返回正在运行的 ffmpeg 进程数
+func (c *Converter) RunningFFmpeg() int {
+	return len(c.ffmpeg)
+}
+
+// ffmpegError 是 ffmpeg 执行失败的错误，Detail 返回其最后输出的警告与错误日志
+type ffmpegError struct {
+	err  error
+	diag *ffmpegDiag
+}
+
+func (e *ffmpegError) Error() string {
+	msg := "ffmpeg执行失败: " + e.err.Error()
+	if last := e.diag.lastError(); last != "" {
+		msg += ": " + last
+	}
+	return msg
+}
+
+func (e *ffmpegError) Unwrap() error { return e.err }
+
+func (e *ffmpegError) Detail() string { return e.diag.String() }
+
+// transcode 调用 ffmpeg 转码，onProgress 可为 nil
+func (c *Converter) transcode(ctx context.Context, inputPath, outputPath string, format OutputFormat, strip bool, onProgress func(percent float64)) error {
+	// 只输出第一条音频流；保留封面时再映射可能存在的视频流。音频文件中的视频流
+	// 即 attached_pic 封面，原样复制并沿用输入的处置标记，没有封面时不产生视频流
+	args := []string{"-map", "0:a:0"}
+	if strip {
+		args = append(args, "-map_metadata", "-1")
+	} else {
+		args = append(args, "-map_metadata", "0")
+		if !format.NoPic {
+			args = append(args, "-map", "0:v?", "-c:v", "copy")
+		}
+	}
+	args = append(args, format.EncoderArgs(c.encoders[format.Name])...)
+	return c.runFFmpeg(ctx, inputPath, outputPath, format.Name, args, onProgress)
+}
+
+// remux 以流复制的方式重新封装音频流，丢弃全部标签、章节与封面
+func (c *Converter) remux(ctx context.Context, inputPath, outputPath string, format OutputFormat) error {
+	args := []string{
+		"-map", "0:a:0",
+		"-c", "copy",
+		"-map_metadata", "-1",
+		"-map_chapters", "-1",
+		// 不写入 encoder 标签
+		"-fflags", "+bitexact",
+	}
+	return c.runFFmpeg(ctx, inputPath, outputPath, format.Name, args, nil)
+}
+
+// runFFmpeg 以 outArgs 为输出参数执行 ffmpeg，受全局 ffmpeg 进程数限制。onProgress 可为 nil
+func (c *Converter) runFFmpeg(ctx context.Context, inputPath, outputPath, formatName string, outArgs []string, onProgress func(percent float64)) error {
+	if err := c.ffmpeg.Acquire(ctx); err != nil {
+		return err
+	}
+	defer c.ffmpeg.Release()
+
+	args := []string{
+		"-y",
+		"-hide_banner",
+		// info 级别的日志包含输入时长，用于换算 -progress 输出的进度；
+		// level 前缀用于从中挑出警告与错误
+		"-loglevel", "level+info",
+		"-nostats",
+		"-progress", "pipe:1",
+		"-i", inputPath,
+	}
+	args = append(args, outArgs...)
+	args = append(args, outputPath)
+	cmd := exec.CommandContext(ctx, c.ffmpegBin, args...)
+
+	logger := logging.FromContext(ctx).With(zap.String("format", formatName))
+	logged := -1
+	progress := newFFmpegProgress(func(percent float64) {
+		// 日志只记录每 25% 的进度
+		if step := int(percent) / 25; step > logged {
+			logged = step
+			logger.Debug("ffmpeg progress", zap.Float64("percent", percent))
+		}
+		if onProgress != nil {
+			onProgress(percent)
+		}
+	})
+	diag := &ffmpegDiag{}
+	stdout := &lineWriter{fn: progress.progressLine}
+	stderr := &lineWriter{fn: func(line string) {
+		progress.stderrLine(line)
+		diag.add(line)
+	}}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	logger.Debug("ffmpeg start", zap.Strings("args", args))
+	start := time.Now()
+	err := cmd.Run()
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		// 删除被中断或失败时留下的不完整输出
+		_ = os.Remove(outputPath)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			logger.Warn("ffmpeg aborted", zap.Duration("took", time.Since(start)), zap.Error(ctxErr))
+			return fmt.Errorf("ffmpeg已中止: %w", ctxErr)
+		}
+		ffErr := &ffmpegError{err: err, diag: diag}
+		logger.Warn("ffmpeg failed",
+			zap.Duration("took", time.Since(start)),
+			zap.Error(err),
+			zap.String("stderr", ffErr.Detail()))
+		return ffErr
+	}
+	logger.Debug("ffmpeg done",
+		zap.Duration("took", time.Since(start)),
+		zap.Duration("input", progress.duration()),
+		zap.String("stderr", diag.String()))
+	return nil
+}
+
+// SniffAudioExt 根据文件头判断解密后的音频格式，返回带点的扩展名
+func SniffAudioExt(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return ".flac", nil
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return ".mp3", nil
+	case head[0] == 0xFF && (head[1]&0xE0) == 0xE0:
+		return ".mp3", nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return ".ogg", nil
+	case bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		return ".wav", nil
+	case bytes.HasPrefix(head, []byte("MAC ")):
+		return ".ape", nil
+	case bytes.Equal(head[4:8], []byte("ftyp")):
+		return ".m4a", nil
+	default:
+		return "", fmt.Errorf("未知音频头: %x", head)
+	}
+}
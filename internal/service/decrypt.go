@@ -1,56 +1,115 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"kgm2flac-backend/internal/logging"
 	"kgm2flac-backend/internal/utils"
 	"os"
 	"path/filepath"
+
+	"go.uber.org/zap"
 	common "unlock-music.dev/cli/algo/common"
-	"unlock-music.dev/cli/algo/kgm"
 )
 
+// ErrUnknownCipher 表示没有解码器能识别输入文件
+var ErrUnknownCipher = errors.New("无法识别的加密格式")
+
+// DecryptService 按扩展名选择解码器解密文件，日志写入 ctx 中的 logger
 type DecryptService struct{}
 
 func NewDecryptService() *DecryptService {
 	return &DecryptService{}
 }
 
-func (s *DecryptService) DecryptKgmFile(inPath string) (outPath string, cleanup func(), err error) {
-	// 从原decryptKgmPureGo函数迁移
+// DecryptResult 是一次解密的产物
+type DecryptResult struct {
+	Path   string    // 解密后的临时文件
+	Cipher string    // 识别出的加密格式
+	Meta   *Metadata // 解码器自带的标签，可能为 nil
+}
+
+// DecryptFile 根据原始文件名的扩展名选择解码器，失败时依次探测其余解码器，
+// 解密结果写入 outDir 下的临时文件。ctx 取消时停止解密并删除已写出的部分
+func (s *DecryptService) DecryptFile(ctx context.Context, inPath, origName, outDir string) (res *DecryptResult, cleanup func(), err error) {
 	in, err := os.Open(inPath)
 	if err != nil {
-		return "", func() {}, err
+		return nil, func() {}, err
 	}
 	defer in.Close()
 
-	dec := kgm.NewDecoder(&common.DecoderParams{Reader: in})
-	if err := dec.Validate(); err != nil {
-		return "", func() {}, fmt.Errorf("不是有效的 KGM/KGMA/VPR 文件: %w", err)
+	ext := filepath.Ext(origName)
+	dec, cipher, err := s.probe(ctx, in, inPath, ext, candidates(ext))
+	if err != nil {
+		return nil, func() {}, err
 	}
+	return s.decryptTo(ctx, dec, cipher, outDir)
+}
 
-	outPath = filepath.Join(os.TempDir(), fmt.Sprintf("kgm_dec_%s.bin", utils.RandHex(8)))
+// decryptTo 将已通过校验的解码器输出写入 outDir 下的临时文件
+func (s *DecryptService) decryptTo(ctx context.Context, dec common.Decoder, cipher, outDir string) (res *DecryptResult, cleanup func(), err error) {
+	outPath := filepath.Join(outDir, fmt.Sprintf("kgm_dec_%s.bin", utils.RandHex(8)))
 	out, e := os.Create(outPath)
 	if e != nil {
-		return "", func() {}, e
+		return nil, func() {}, e
 	}
 	defer out.Close()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(outPath)
+		}
+	}()
 
 	buf := make([]byte, 64*1024)
 	for {
+		if e := ctx.Err(); e != nil {
+			return nil, func() {}, e
+		}
 		n, e := dec.Read(buf)
 		if n > 0 {
 			if _, werr := out.Write(buf[:n]); werr != nil {
-				return "", func() {}, werr
+				return nil, func() {}, werr
 			}
 		}
 		if errors.Is(e, io.EOF) {
 			break
 		}
 		if e != nil {
-			return "", func() {}, e
+			return nil, func() {}, e
+		}
+	}
+
+	res = &DecryptResult{
+		Path:   outPath,
+		Cipher: cipher,
+		Meta:   metadataFromDecoder(ctx, dec),
+	}
+	return res, func() { _ = os.Remove(outPath) }, nil
+}
+
+// probe 依次尝试候选解码器的 Validate，返回第一个通过校验的解码器
+func (s *DecryptService) probe(ctx context.Context, in io.ReadSeeker, inPath, ext string, cands []decoderEntry) (common.Decoder, string, error) {
+	logger := logging.FromContext(ctx)
+	var errs []error
+	for _, d := range cands {
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return nil, "", err
+		}
+		dec := d.create(&common.DecoderParams{
+			Reader:    in,
+			Extension: ext,
+			FilePath:  inPath,
+			Logger:    logger.Named("decoder"),
+		})
+		if err := dec.Validate(); err != nil {
+			logger.Debug("cipher probe failed", zap.String("ext", ext), zap.String("cipher", d.cipher), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", d.cipher, err))
+			continue
 		}
+		logger.Debug("cipher detected", zap.String("ext", ext), zap.String("cipher", d.cipher))
+		return dec, d.cipher, nil
 	}
-	return outPath, func() { _ = os.Remove(outPath) }, nil
+	return nil, "", fmt.Errorf("%w: %w", ErrUnknownCipher, errors.Join(errs...))
 }
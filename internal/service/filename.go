@@ -0,0 +1,77 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// artistSeparators 用于拆分多个歌手
+var artistSeparators = regexp.MustCompile(`\s*[、,，/;；]\s*`)
+
+// FilenameParser 按命名规则从文件名中解析标签
+type FilenameParser struct {
+	patterns []*regexp.Regexp
+}
+
+// NewFilenameParser 编译命名规则，按顺序匹配。
+// 支持的命名分组：artist、title、album、version，title 为必需
+func NewFilenameParser(patterns []string) (*FilenameParser, error) {
+	p := &FilenameParser{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("文件名规则 %q 无效: %w", pattern, err)
+		}
+		if re.SubexpIndex("title") < 0 {
+			return nil, fmt.Errorf("文件名规则 %q 缺少 title 分组", pattern)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+// Parse 解析文件名（忽略目录与扩展名），没有规则匹配时返回 nil
+func (p *FilenameParser) Parse(filename string) *Metadata {
+	base := filepath.Base(filename)
+	base = strings.TrimSpace(strings.TrimSuffix(base, filepath.Ext(base)))
+	if base == "" {
+		return nil
+	}
+
+	for _, re := range p.patterns {
+		m := re.FindStringSubmatch(base)
+		if m == nil {
+			continue
+		}
+		meta := &Metadata{}
+		for i, name := range re.SubexpNames() {
+			v := strings.TrimSpace(m[i])
+			switch name {
+			case "artist":
+				meta.Artists = splitArtists(v)
+			case "title":
+				meta.Title = v
+			case "album":
+				meta.Album = v
+			case "version":
+				meta.Version = v
+			}
+		}
+		if meta.Title != "" {
+			return meta
+		}
+	}
+	return nil
+}
+
+func splitArtists(s string) []string {
+	var artists []string
+	for _, a := range artistSeparators.Split(s, -1) {
+		if a = strings.TrimSpace(a); a != "" {
+			artists = append(artists, a)
+		}
+	}
+	return artists
+}
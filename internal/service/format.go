@@ -0,0 +1,157 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OutputFormat 描述一种输出格式及其 ffmpeg 编码参数
+type OutputFormat struct {
+	Name  string   // 格式名称，即请求参数取值
+	Ext   string   // 输出扩展名（含点）
+	MIME  string   // 响应 Content-Type
+	Codec string   // ffmpeg -c:a 编码器
+	Args  []string // 默认编码参数，可被配置覆盖
+	NoPic bool     // 容器不支持内嵌封面，不映射视频流
+}
+
+var outputFormats = map[string]OutputFormat{
+	"flac": {Name: "flac", Ext: ".flac", MIME: "audio/flac", Codec: "flac", Args: []string{"-compression_level", "5"}},
+	"alac": {Name: "alac", Ext: ".m4a", MIME: "audio/mp4", Codec: "alac"},
+	"wav":  {Name: "wav", Ext: ".wav", MIME: "audio/wav", Codec: "pcm_s16le", NoPic: true},
+	"mp3":  {Name: "mp3", Ext: ".mp3", MIME: "audio/mpeg", Codec: "libmp3lame", Args: []string{"-b:a", "320k"}},
+	"opus": {Name: "opus", Ext: ".opus", MIME: "audio/ogg", Codec: "libopus", Args: []string{"-b:a", "192k"}, NoPic: true},
+	"aac":  {Name: "aac", Ext: ".m4a", MIME: "audio/mp4", Codec: "aac", Args: []string{"-b:a", "256k"}},
+}
+
+// 特殊输出模式，与输出格式共用 format 参数
+const (
+	ModePassthrough = "passthrough" // 原样输出解密后的音频流
+	ModeAuto        = "auto"        // 无损源转为 FLAC，有损源原样输出
+)
+
+// 转换动作，按文件记录实际采取的处理方式
+const (
+	ActionPassthrough = "passthrough"
+	ActionTranscode   = "transcode"
+)
+
+// sourceFormat 描述解密后可能出现的音频容器
+type sourceFormat struct {
+	MIME     string
+	Lossless bool
+	NoMux    bool // ffmpeg 无法写出该容器，原样输出时不能重新封装以清除标签
+}
+
+// m4a 可能是 ALAC 也可能是 AAC，无法仅凭文件头区分，按有损处理
+var sourceFormats = map[string]sourceFormat{
+	".flac": {MIME: "audio/flac", Lossless: true},
+	".wav":  {MIME: "audio/wav", Lossless: true},
+	".ape":  {MIME: "audio/x-ape", Lossless: true, NoMux: true},
+	".mp3":  {MIME: "audio/mpeg"},
+	".ogg":  {MIME: "audio/ogg"},
+	".m4a":  {MIME: "audio/mp4"},
+}
+
+// IsLossless 判断嗅探出的源格式是否为无损
+func IsLossless(ext string) bool {
+	return sourceFormats[ext].Lossless
+}
+
+// MIMEByExt 根据输出文件扩展名返回 Content-Type
+func MIMEByExt(ext string) string {
+	if sf, ok := sourceFormats[ext]; ok {
+		return sf.MIME
+	}
+	for _, f := range outputFormats {
+		if f.Ext == ext {
+			return f.MIME
+		}
+	}
+	return "application/octet-stream"
+}
+
+// ValidChoice 判断 format 参数取值是否合法（输出格式或特殊模式）
+func ValidChoice(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == ModeAuto || name == ModePassthrough {
+		return name, true
+	}
+	f, ok := outputFormats[name]
+	return f.Name, ok
+}
+
+// Choices 返回 format 参数的所有可选值，特殊模式在前
+func Choices() []string {
+	return append([]string{ModeAuto, ModePassthrough}, FormatNames()...)
+}
+
+// PlanOutput 根据请求的格式或模式以及源格式决定输出方式。
+// 返回的 OutputFormat 在原样输出时 Ext 为源扩展名
+func PlanOutput(choice, srcExt string) (OutputFormat, string, error) {
+	passthrough := OutputFormat{
+		Name: strings.TrimPrefix(srcExt, "."),
+		Ext:  srcExt,
+		MIME: MIMEByExt(srcExt),
+	}
+
+	switch choice {
+	case ModePassthrough:
+		return passthrough, ActionPassthrough, nil
+	case ModeAuto:
+		if !IsLossless(srcExt) {
+			return passthrough, ActionPassthrough, nil
+		}
+		choice = "flac"
+	}
+
+	f, ok := LookupFormat(choice)
+	if !ok {
+		return OutputFormat{}, "", fmt.Errorf("不支持的输出格式: %s", choice)
+	}
+	// 源本身就是 FLAC 时无需再转码
+	if srcExt == ".flac" && f.Name == "flac" {
+		return f, ActionPassthrough, nil
+	}
+	return f, ActionTranscode, nil
+}
+
+// LookupFormat 按名称（不区分大小写）查找输出格式
+func LookupFormat(name string) (OutputFormat, bool) {
+	f, ok := outputFormats[strings.ToLower(strings.TrimSpace(name))]
+	return f, ok
+}
+
+// FormatNames 返回所有支持的输出格式名称（已排序）
+func FormatNames() []string {
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EncoderArgs 返回编码相关的 ffmpeg 参数，override 非空时替换默认参数
+func (f OutputFormat) EncoderArgs(override []string) []string {
+	args := []string{"-c:a", f.Codec}
+	if override != nil {
+		return append(args, override...)
+	}
+	return append(args, f.Args...)
+}
+
+// OutputExts 返回 choice 可能产生的输出扩展名，用于判断文件是否已经转换过。
+// 特殊模式下输出扩展名取决于源格式
+func OutputExts(choice string) []string {
+	if f, ok := LookupFormat(choice); ok {
+		return []string{f.Ext}
+	}
+	exts := make([]string, 0, len(sourceFormats))
+	for ext := range sourceFormats {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
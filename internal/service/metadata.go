@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-flac/flacpicture"
+	"github.com/go-flac/flacvorbis"
+	flac "github.com/go-flac/go-flac"
+	common "unlock-music.dev/cli/algo/common"
+)
+
+// Metadata 是需要写入输出文件的标签
+type Metadata struct {
+	Title     string
+	Artists   []string
+	Album     string
+	Version   string // 版本标记，如 Live、伴奏
+	Cover     []byte
+	CoverMIME string
+}
+
+// IsEmpty 判断是否没有任何可写入的标签
+func (m *Metadata) IsEmpty() bool {
+	return m == nil || (m.Title == "" && len(m.Artists) == 0 && m.Album == "" && m.Version == "" && len(m.Cover) == 0)
+}
+
+// metadataFromDecoder 读取解码器自带的标签与封面（如 NCM），解码器不支持时返回 nil
+func metadataFromDecoder(ctx context.Context, dec common.Decoder) *Metadata {
+	meta := &Metadata{}
+	if g, ok := dec.(common.AudioMetaGetter); ok {
+		if am, err := g.GetAudioMeta(ctx); err == nil && am != nil {
+			meta.Title = am.GetTitle()
+			meta.Artists = am.GetArtists()
+			meta.Album = am.GetAlbum()
+		}
+	}
+	if g, ok := dec.(common.CoverImageGetter); ok {
+		if cover, err := g.GetCoverImage(ctx); err == nil && len(cover) > 0 {
+			meta.Cover = cover
+			meta.CoverMIME = http.DetectContentType(cover)
+		}
+	}
+	if meta.IsEmpty() {
+		return nil
+	}
+	return meta
+}
+
+// TagFlac 将 meta 写入 FLAC 文件：只补充缺失的 Vorbis 字段，已有图片块时不再追加封面。
+// fallback（如从文件名解析出的标签）仅在文件原本没有 TITLE 与 ARTIST 时使用。
+// 封面无法写入时仍写入文字标签，并返回说明跳过封面的错误
+func TagFlac(path string, meta, fallback *Metadata) error {
+	if meta.IsEmpty() && fallback.IsEmpty() {
+		return nil
+	}
+	var coverErr error
+	err := rewriteFlac(path, func(blocks []*flac.MetaDataBlock) ([]*flac.MetaDataBlock, error) {
+		cmtIdx := -1
+		hasPicture := false
+		cmt := flacvorbis.New()
+		for i, b := range blocks {
+			switch b.Type {
+			case flac.VorbisComment:
+				parsed, err := flacvorbis.ParseFromMetaDataBlock(*b)
+				if err != nil {
+					return nil, fmt.Errorf("解析 Vorbis 注释失败: %w", err)
+				}
+				cmt, cmtIdx = parsed, i
+			case flac.Picture:
+				hasPicture = true
+			}
+		}
+
+		title, _ := cmt.Get(flacvorbis.FIELD_TITLE)
+		artist, _ := cmt.Get(flacvorbis.FIELD_ARTIST)
+		untagged := len(title) == 0 && len(artist) == 0
+
+		addComments(cmt, meta)
+		if untagged {
+			addComments(cmt, fallback)
+		}
+
+		cmtBlock := cmt.Marshal()
+		if cmtIdx >= 0 {
+			blocks[cmtIdx] = &cmtBlock
+		} else {
+			blocks = append(blocks, &cmtBlock)
+		}
+
+		if !hasPicture && meta != nil && len(meta.Cover) > 0 {
+			pic, err := flacpicture.NewFromImageData(flacpicture.PictureTypeFrontCover, "Front cover", meta.Cover, meta.CoverMIME)
+			if err != nil {
+				// 封面格式不受支持（如 WebP）时跳过封面，文字标签照常写入
+				coverErr = fmt.Errorf("已跳过封面（%s）: %w", meta.CoverMIME, err)
+			} else {
+				picBlock := pic.Marshal()
+				blocks = append(blocks, &picBlock)
+			}
+		}
+		return blocks, nil
+	})
+	if err != nil {
+		return err
+	}
+	return coverErr
+}
+
+// StripFlac 删除 FLAC 文件中的 Vorbis 注释与图片块
+func StripFlac(path string) error {
+	return rewriteFlac(path, func(blocks []*flac.MetaDataBlock) ([]*flac.MetaDataBlock, error) {
+		kept := blocks[:0]
+		for _, b := range blocks {
+			if b.Type == flac.VorbisComment || b.Type == flac.Picture {
+				continue
+			}
+			kept = append(kept, b)
+		}
+		return kept, nil
+	})
+}
+
+// addComments 将 meta 中的字段补充到缺失的 Vorbis 注释
+func addComments(cmt *flacvorbis.MetaDataBlockVorbisComment, meta *Metadata) {
+	if meta == nil {
+		return
+	}
+	addIfMissing(cmt, flacvorbis.FIELD_TITLE, meta.Title)
+	addIfMissing(cmt, flacvorbis.FIELD_ALBUM, meta.Album)
+	addIfMissing(cmt, flacvorbis.FIELD_VERSION, meta.Version)
+	if existing, _ := cmt.Get(flacvorbis.FIELD_ARTIST); len(existing) == 0 {
+		for _, artist := range meta.Artists {
+			_ = cmt.Add(flacvorbis.FIELD_ARTIST, artist)
+		}
+	}
+}
+
+func addIfMissing(cmt *flacvorbis.MetaDataBlockVorbisComment, key, val string) {
+	if strings.TrimSpace(val) == "" {
+		return
+	}
+	if existing, _ := cmt.Get(key); len(existing) > 0 {
+		return
+	}
+	_ = cmt.Add(key, val)
+}
+
+// rewriteFlac 读取元数据块交给 edit 修改，再与音频帧一起流式写回，避免整文件读入内存
+func rewriteFlac(path string, edit func([]*flac.MetaDataBlock) ([]*flac.MetaDataBlock, error)) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := flac.ParseMetadata(in)
+	if err != nil {
+		return fmt.Errorf("解析 FLAC 元数据失败: %w", err)
+	}
+	blocks, err := edit(f.Meta)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tagging"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := writeFlac(out, blocks, in); err != nil {
+		out.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	in.Close()
+	return os.Rename(tmpPath, path)
+}
+
+func writeFlac(w io.Writer, blocks []*flac.MetaDataBlock, frames io.Reader) error {
+	if _, err := w.Write([]byte("fLaC")); err != nil {
+		return err
+	}
+	for i, b := range blocks {
+		if _, err := w.Write(b.Marshal(i == len(blocks)-1)); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, frames)
+	return err
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ffmpegProgress 根据 ffmpeg 的输出计算转码进度：输入时长取自 stderr 中的
+// "Duration: 00:03:21.47" 一行，已处理的时长取自 -progress pipe:1 在 stdout 上输出的 out_time_us。
+// stdout 与 stderr 由不同的协程读取，先于时长到达的进度在得到时长后补报
+type ffmpegProgress struct {
+	mu     sync.Mutex
+	total  time.Duration // 输入时长，未知时为 0
+	done   time.Duration // 已处理的时长
+	last   int           // 上次报告的整数百分比
+	report func(percent float64)
+}
+
+func newFFmpegProgress(report func(percent float64)) *ffmpegProgress {
+	return &ffmpegProgress{last: -1, report: report}
+}
+
+// duration 返回解析到的输入时长，未知时为 0
+func (p *ffmpegProgress) duration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total
+}
+
+// stderrLine 从 ffmpeg 的日志中取出第一个输入的时长
+func (p *ffmpegProgress) stderrLine(line string) {
+	i := strings.Index(line, "Duration: ")
+	if i < 0 {
+		return
+	}
+	v, _, _ := strings.Cut(line[i+len("Duration: "):], ",")
+	d, ok := parseClock(v)
+	if !ok || d <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total == 0 {
+		p.total = d
+		p.update()
+	}
+}
+
+// progressLine 处理 -progress 输出的一行 key=value
+func (p *ffmpegProgress) progressLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch key {
+	case "out_time_us":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			p.done = time.Duration(us) * time.Microsecond
+			p.update()
+		}
+	case "progress":
+		if value == "end" {
+			p.emit(100)
+		}
+	}
+}
+
+// update 在已处理时长的整数百分比变化时报告，调用方需持有锁。
+// 编码器缓冲等原因可能略超出输入时长，结束前最多报告 99%
+func (p *ffmpegProgress) update() {
+	if p.total > 0 && p.done > 0 {
+		p.emit(min(float64(p.done)*100/float64(p.total), 99))
+	}
+}
+
+func (p *ffmpegProgress) emit(percent float64) {
+	if p.report == nil || int(percent) <= p.last {
+		return
+	}
+	p.last = int(percent)
+	p.report(float64(p.last))
+}
+
+// 诊断输出保留的最大行数与字节数
+const (
+	maxDiagLines = 20
+	maxDiagBytes = 4 << 10
+)
+
+// ffmpegDiag 保留 ffmpeg 最近输出的警告与错误日志，用于说明转码失败的原因。
+// 只由读取 stderr 的协程写入，命令结束后再读取
+type ffmpegDiag struct {
+	lines []string
+	size  int
+}
+
+// add 记录 -loglevel level+info 输出中带有 [warning]、[error] 等级别标记的一行
+func (d *ffmpegDiag) add(line string) {
+	if !strings.Contains(line, "[warning] ") && !strings.Contains(line, "[error] ") &&
+		!strings.Contains(line, "[fatal] ") && !strings.Contains(line, "[panic] ") {
+		return
+	}
+	d.lines = append(d.lines, line)
+	d.size += len(line) + 1
+	for len(d.lines) > maxDiagLines || (d.size > maxDiagBytes && len(d.lines) > 1) {
+		d.size -= len(d.lines[0]) + 1
+		d.lines = d.lines[1:]
+	}
+}
+
+func (d *ffmpegDiag) String() string {
+	return strings.Join(d.lines, "\n")
+}
+
+// lastError 返回最后一条错误日志，没有时返回最后一条警告
+func (d *ffmpegDiag) lastError() string {
+	for i := len(d.lines) - 1; i >= 0; i-- {
+		if !strings.Contains(d.lines[i], "[warning] ") {
+			return d.lines[i]
+		}
+	}
+	if len(d.lines) > 0 {
+		return d.lines[len(d.lines)-1]
+	}
+	return ""
+}
+
+// parseClock 解析 HH:MM:SS.xx 格式的时长，ffmpeg 无法得到时长时输出 N/A
+func parseClock(s string) (time.Duration, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	sec, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)), true
+}
+
+// lineWriter 将写入的内容按行交给 fn，用作 exec.Cmd 的 Stdout/Stderr。
+// 过长的行被截断，避免异常输出占用过多内存
+type lineWriter struct {
+	fn  func(line string)
+	buf []byte
+}
+
+const maxLineBytes = 4 << 10
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			w.buf = append(w.buf, p[:min(len(p), max(maxLineBytes-len(w.buf), 0))]...)
+			break
+		}
+		w.buf = append(w.buf, p[:min(i, max(maxLineBytes-len(w.buf), 0))]...)
+		if len(w.buf) > 0 {
+			w.fn(string(w.buf))
+			w.buf = w.buf[:0]
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close 交出最后一行没有换行符的内容
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
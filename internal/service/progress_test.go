@@ -0,0 +1,200 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{in: "00:03:21.47", want: 3*time.Minute + 21470*time.Millisecond, ok: true},
+		{in: " 01:00:00.00 ", want: time.Hour, ok: true},
+		{in: "00:00:05", want: 5 * time.Second, ok: true},
+		{in: "N/A"},
+		{in: "03:21.47"},
+		{in: "aa:00:00.00"},
+		{in: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseClock(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseClock(%q) = %v, %t, want %v, %t", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFFmpegProgress(t *testing.T) {
+	const duration = "  Duration: 00:00:10.00, start: 0.000000, bitrate: 1000 kb/s"
+	tests := []struct {
+		name  string
+		lines []string // "err:" 前缀的行来自 stderr，其余来自 -progress 输出
+		want  []float64
+	}{
+		{
+			name:  "先得到时长",
+			lines: []string{"err:" + duration, "out_time_us=2500000", "progress=continue", "out_time_us=5000000", "progress=end"},
+			want:  []float64{25, 50, 100},
+		},
+		{
+			name:  "进度先于时长到达时补报",
+			lines: []string{"out_time_us=5000000", "err:" + duration, "out_time_us=7500000"},
+			want:  []float64{50, 75},
+		},
+		{
+			name:  "时长未知时只报告结束",
+			lines: []string{"err:  Duration: N/A, bitrate: N/A", "out_time_us=5000000", "progress=end"},
+			want:  []float64{100},
+		},
+		{
+			name:  "超出时长时结束前最多 99",
+			lines: []string{"err:" + duration, "out_time_us=12000000", "progress=end"},
+			want:  []float64{99, 100},
+		},
+		{
+			name:  "相同的整数百分比只报告一次",
+			lines: []string{"err:" + duration, "out_time_us=2500000", "out_time_us=2550000", "out_time_us=2600000"},
+			want:  []float64{25, 26},
+		},
+		{
+			name:  "只使用第一个时长",
+			lines: []string{"err:" + duration, "err:  Duration: 00:00:20.00, start: 0", "out_time_us=5000000"},
+			want:  []float64{50},
+		},
+		{
+			name:  "忽略无效的进度",
+			lines: []string{"err:" + duration, "out_time_us=N/A", "out_time_us=-1", "frame=0", "garbage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []float64
+			p := newFFmpegProgress(func(percent float64) { got = append(got, percent) })
+			for _, line := range tt.lines {
+				if s, ok := strings.CutPrefix(line, "err:"); ok {
+					p.stderrLine(s)
+				} else {
+					p.progressLine(line)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFFmpegDiag(t *testing.T) {
+	many := make([]string, maxDiagLines+5)
+	for i := range many {
+		many[i] = fmt.Sprintf("[mp3 @ 0x1] [error] line %d", i)
+	}
+	long := "[error] " + strings.Repeat("x", maxDiagBytes/2)
+
+	tests := []struct {
+		name      string
+		lines     []string
+		want      []string
+		lastError string
+	}{
+		{
+			name: "只保留警告与错误",
+			lines: []string{
+				"[info] Input #0, flac, from 'in.flac':",
+				"[flac @ 0x1] [warning] Invalid PNG signature",
+				"[out#0/mp3 @ 0x2] [error] Error opening output",
+				"[fatal] Conversion failed!",
+			},
+			want: []string{
+				"[flac @ 0x1] [warning] Invalid PNG signature",
+				"[out#0/mp3 @ 0x2] [error] Error opening output",
+				"[fatal] Conversion failed!",
+			},
+			lastError: "[fatal] Conversion failed!",
+		},
+		{
+			name:      "最后的错误优先于之后的警告",
+			lines:     []string{"[error] bad frame", "[warning] skipped"},
+			want:      []string{"[error] bad frame", "[warning] skipped"},
+			lastError: "[error] bad frame",
+		},
+		{
+			name:      "只有警告",
+			lines:     []string{"[warning] a", "[warning] b"},
+			want:      []string{"[warning] a", "[warning] b"},
+			lastError: "[warning] b",
+		},
+		{
+			name:      "没有诊断输出",
+			lines:     []string{"[info] Stream mapping:"},
+			want:      nil,
+			lastError: "",
+		},
+		{
+			name:      "超出行数时保留最近的行",
+			lines:     many,
+			want:      many[len(many)-maxDiagLines:],
+			lastError: many[len(many)-1],
+		},
+		{
+			name:      "超出字节数时保留最近的行",
+			lines:     []string{long, long, "[error] last"},
+			want:      []string{long, "[error] last"},
+			lastError: "[error] last",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &ffmpegDiag{}
+			for _, line := range tt.lines {
+				d.add(line)
+			}
+			if !reflect.DeepEqual(d.lines, tt.want) {
+				t.Errorf("lines = %q, want %q", d.lines, tt.want)
+			}
+			if got := d.String(); got != strings.Join(tt.want, "\n") {
+				t.Errorf("String() = %q", got)
+			}
+			if got := d.lastError(); got != tt.lastError {
+				t.Errorf("lastError() = %q, want %q", got, tt.lastError)
+			}
+		})
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{name: "按行拆分", writes: []string{"a=1\nb=2\n"}, want: []string{"a=1", "b=2"}},
+		{name: "跨多次写入的行", writes: []string{"out_ti", "me_us=5", "\nprogress=end\n"}, want: []string{"out_time_us=5", "progress=end"}},
+		{name: "回车与空行", writes: []string{"a\r\n\r\nb\rc\n"}, want: []string{"a", "b", "c"}},
+		{name: "Close 交出最后一行", writes: []string{"a\nb"}, want: []string{"a", "b"}},
+		{name: "截断过长的行", writes: []string{strings.Repeat("x", maxLineBytes), strings.Repeat("y", 10) + "\nz\n"}, want: []string{strings.Repeat("x", maxLineBytes), "z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			w := &lineWriter{fn: func(line string) { got = append(got, line) }}
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			w.Close()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"sort"
+	"strings"
+
+	common "unlock-music.dev/cli/algo/common"
+	"unlock-music.dev/cli/algo/kgm"
+	"unlock-music.dev/cli/algo/kwm"
+	"unlock-music.dev/cli/algo/ncm"
+	"unlock-music.dev/cli/algo/qmc"
+	"unlock-music.dev/cli/algo/tm"
+)
+
+// decoderEntry 描述一种加密格式及其解码器
+type decoderEntry struct {
+	cipher string
+	exts   []string
+	create common.NewDecoderFunc
+}
+
+// decoders 按注册顺序保存，扩展名无法匹配时按此顺序逐个探测
+var decoders []decoderEntry
+
+func init() {
+	RegisterDecoder("kgm", kgm.NewDecoder, ".kgm", ".kgma", ".vpr")
+	RegisterDecoder("ncm", ncm.NewDecoder, ".ncm")
+	RegisterDecoder("qmc", qmc.NewDecoder,
+		".qmc0", ".qmc2", ".qmc3", ".qmc4", ".qmc6", ".qmc8",
+		".qmcflac", ".qmcogg", ".tkm",
+		".mflac", ".mflac0", ".mflach", ".mgg", ".mgg0", ".mgg1", ".mggl", ".mmp4",
+		".bkcmp3", ".bkcflac", ".666c6163", ".6d7033", ".6f6767", ".6d3461", ".776176")
+	RegisterDecoder("kwm", kwm.NewDecoder, ".kwm")
+	RegisterDecoder("tm", tm.NewTmDecoder, ".tm0", ".tm2", ".tm3", ".tm6")
+}
+
+// RegisterDecoder 注册解码器，cipher 为格式名称，exts 为对应的文件扩展名（含点）
+func RegisterDecoder(cipher string, create common.NewDecoderFunc, exts ...string) {
+	lowered := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		lowered = append(lowered, strings.ToLower(ext))
+	}
+	decoders = append(decoders, decoderEntry{cipher: cipher, exts: lowered, create: create})
+}
+
+// SupportedExts 返回所有已注册的扩展名（含点，已排序）
+func SupportedExts() []string {
+	var exts []string
+	for _, d := range decoders {
+		exts = append(exts, d.exts...)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// IsSupportedExt 判断扩展名（含点，不区分大小写）是否有对应的解码器
+func IsSupportedExt(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, d := range decoders {
+		if hasExt(d.exts, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates 返回探测顺序：扩展名匹配的解码器优先，其余按注册顺序追加
+func candidates(ext string) []decoderEntry {
+	ext = strings.ToLower(ext)
+	matched := make([]decoderEntry, 0, len(decoders))
+	var rest []decoderEntry
+	for _, d := range decoders {
+		if hasExt(d.exts, ext) {
+			matched = append(matched, d)
+		} else {
+			rest = append(rest, d)
+		}
+	}
+	return append(matched, rest...)
+}
+
+func hasExt(exts []string, ext string) bool {
+	for _, e := range exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kgm2flac-backend/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// streamHeadSize 是流式解密时缓存在内存中的文件头大小，
+// 解码器在这一范围内的回退定位都可以满足，探测失败时也能回退为落盘处理
+const streamHeadSize = 64 * 1024
+
+// streamableCiphers 中的解码器只需要文件头并顺序读取音频数据，可以直接解密上传流
+var streamableCiphers = map[string]bool{
+	"kgm": true,
+}
+
+var errSeekBackward = errors.New("上传流不支持回退定位")
+
+// DecryptStream 解密只能顺序读取的上传流。扩展名对应可流式处理的格式时直接边读边解密，
+// 否则先将流落盘到 outDir 再按 DecryptFile 处理
+func (s *DecryptService) DecryptStream(ctx context.Context, r io.Reader, origName, outDir string) (*DecryptResult, func(), error) {
+	ext := filepath.Ext(origName)
+
+	head := make([]byte, streamHeadSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, func() {}, err
+	}
+	head = head[:n]
+
+	var streamErr error
+	if cands := streamCandidates(ext); len(cands) > 0 {
+		hs := &headSeeker{head: head, rest: r}
+		dec, cipher, err := s.probe(ctx, hs, "", ext, cands)
+		if err == nil {
+			return s.decryptTo(ctx, dec, cipher, outDir)
+		}
+		if hs.restRead {
+			// 已经越过缓存的文件头，无法再回退到落盘处理
+			return nil, func() {}, err
+		}
+		streamErr = err
+	}
+
+	// 落盘后按随机访问方式处理
+	spool := filepath.Join(outDir, fmt.Sprintf("kgm_%s%s", utils.RandHex(8), ext))
+	f, err := os.Create(spool)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	defer os.Remove(spool)
+	if _, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), r)); err != nil {
+		f.Close()
+		return nil, func() {}, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, func() {}, err
+	}
+
+	res, cleanup, err := s.DecryptFile(ctx, spool, origName, outDir)
+	if err != nil && streamErr != nil {
+		err = errors.Join(streamErr, err)
+	}
+	return res, cleanup, err
+}
+
+// streamCandidates 返回扩展名匹配且支持流式解密的解码器
+func streamCandidates(ext string) []decoderEntry {
+	var cands []decoderEntry
+	for _, d := range candidates(ext) {
+		if !hasExt(d.exts, strings.ToLower(ext)) {
+			break
+		}
+		if streamableCiphers[d.cipher] {
+			cands = append(cands, d)
+		}
+	}
+	return cands
+}
+
+// headSeeker 为只能顺序读取的流提供有限的 Seek：
+// 缓存的文件头范围内可以任意定位，越过文件头后只能向前跳过
+type headSeeker struct {
+	head     []byte
+	rest     io.Reader
+	pos      int64
+	restRead bool
+}
+
+func (h *headSeeker) Read(p []byte) (int, error) {
+	if h.pos < int64(len(h.head)) {
+		n := copy(p, h.head[h.pos:])
+		h.pos += int64(n)
+		return n, nil
+	}
+	n, err := h.rest.Read(p)
+	if n > 0 {
+		h.restRead = true
+	}
+	h.pos += int64(n)
+	return n, err
+}
+
+func (h *headSeeker) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = h.pos + offset
+	default:
+		return h.pos, errors.New("上传流不支持从末尾定位")
+	}
+	if target < 0 {
+		return h.pos, errors.New("无效的定位位置")
+	}
+
+	headLen := int64(len(h.head))
+	if target <= headLen && !h.restRead {
+		h.pos = target
+		return target, nil
+	}
+	if target < h.pos {
+		return h.pos, errSeekBackward
+	}
+
+	// 向前跳过：先用完缓存的文件头，再丢弃流中的数据
+	if h.pos < headLen {
+		h.pos = headLen
+	}
+	if skip := target - h.pos; skip > 0 {
+		n, err := io.CopyN(io.Discard, h.rest, skip)
+		h.pos += n
+		h.restRead = true
+		if err != nil {
+			return h.pos, err
+		}
+	}
+	return h.pos, nil
+}
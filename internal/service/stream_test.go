@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	common "unlock-music.dev/cli/algo/common"
+)
+
+func TestHeadSeeker(t *testing.T) {
+	type step struct {
+		seek    bool
+		offset  int64
+		whence  int
+		read    int    // seek 为 false 时读取的字节数
+		want    string // 读到的数据
+		wantPos int64
+		wantErr error // 为 errAny 时只要求出错
+	}
+	errAny := errors.New("any")
+	tests := []struct {
+		name     string
+		steps    []step
+		restRead bool
+	}{
+		{
+			name: "文件头内任意回退",
+			steps: []step{
+				{seek: true, offset: 5, wantPos: 5},
+				{read: 3, want: "567", wantPos: 8},
+				{seek: true, offset: 2, wantPos: 2},
+				{read: 3, want: "234", wantPos: 5},
+			},
+		},
+		{
+			name: "相对当前位置定位",
+			steps: []step{
+				{seek: true, offset: 3, wantPos: 3},
+				{seek: true, offset: 4, whence: io.SeekCurrent, wantPos: 7},
+				{seek: true, offset: -7, whence: io.SeekCurrent, wantPos: 0},
+			},
+		},
+		{
+			name: "定位到文件头末尾不读取流",
+			steps: []step{
+				{seek: true, offset: 10, wantPos: 10},
+				{seek: true, offset: 0, wantPos: 0},
+			},
+		},
+		{
+			name: "跨过文件头读取",
+			steps: []step{
+				{seek: true, offset: 8, wantPos: 8},
+				{read: 4, want: "89ab", wantPos: 12},
+			},
+			restRead: true,
+		},
+		{
+			name: "读过流之后不能回退到文件头",
+			steps: []step{
+				{read: 12, want: "0123456789ab", wantPos: 12},
+				{seek: true, offset: 0, wantPos: 12, wantErr: errSeekBackward},
+				{seek: true, offset: 14, wantPos: 14},
+				{read: 2, want: "ef", wantPos: 16},
+			},
+			restRead: true,
+		},
+		{
+			name: "向前越过文件头时丢弃流中的数据",
+			steps: []step{
+				{seek: true, offset: 2, wantPos: 2},
+				{seek: true, offset: 15, wantPos: 15},
+				{read: 3, want: "fgh", wantPos: 18},
+				{seek: true, offset: 12, wantPos: 18, wantErr: errSeekBackward},
+			},
+			restRead: true,
+		},
+		{
+			name: "越过流末尾",
+			steps: []step{
+				{seek: true, offset: 30, wantPos: 20, wantErr: io.EOF},
+			},
+			restRead: true,
+		},
+		{
+			name: "不支持从末尾定位",
+			steps: []step{
+				{seek: true, offset: 0, whence: io.SeekEnd, wantPos: 0, wantErr: errAny},
+			},
+		},
+		{
+			name: "无效的位置",
+			steps: []step{
+				{seek: true, offset: 4, wantPos: 4},
+				{seek: true, offset: -5, whence: io.SeekCurrent, wantPos: 4, wantErr: errAny},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &headSeeker{head: []byte("0123456789"), rest: strings.NewReader("abcdefghij")}
+			for i, s := range tt.steps {
+				var pos int64
+				var err error
+				if s.seek {
+					pos, err = h.Seek(s.offset, s.whence)
+				} else {
+					buf := make([]byte, s.read)
+					var n int
+					n, err = io.ReadFull(h, buf)
+					if got := string(buf[:n]); got != s.want {
+						t.Errorf("step %d: read %q, want %q", i, got, s.want)
+					}
+					pos = h.pos
+				}
+				switch {
+				case s.wantErr == errAny:
+					if err == nil {
+						t.Errorf("step %d: err = nil, want error", i)
+					}
+				case !errors.Is(err, s.wantErr):
+					t.Errorf("step %d: err = %v, want %v", i, err, s.wantErr)
+				}
+				if pos != s.wantPos {
+					t.Errorf("step %d: pos = %d, want %d", i, pos, s.wantPos)
+				}
+			}
+			if h.restRead != tt.restRead {
+				t.Errorf("restRead = %t, want %t", h.restRead, tt.restRead)
+			}
+		})
+	}
+}
+
+// fakeDecoder 在 offset 处校验 magic，通过后输出其后的全部数据
+type fakeDecoder struct {
+	r      io.ReadSeeker
+	offset int64
+	magic  string
+}
+
+func (d *fakeDecoder) Validate() error {
+	if _, err := d.r.Seek(d.offset, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, len(d.magic))
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return err
+	}
+	if string(buf) != d.magic {
+		return errors.New("magic mismatch")
+	}
+	return nil
+}
+
+func (d *fakeDecoder) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+func fakeDecoderFunc(offset int64, magic string) common.NewDecoderFunc {
+	return func(p *common.DecoderParams) common.Decoder {
+		return &fakeDecoder{r: p.Reader, offset: offset, magic: magic}
+	}
+}
+
+// useFakeDecoders 在测试期间只保留两个 .fake 解码器：可流式处理的 fakestream 与只能落盘处理的 fakefile
+func useFakeDecoders(t *testing.T, streamOffset int64) {
+	saved, savedStreamable := decoders, streamableCiphers
+	t.Cleanup(func() { decoders, streamableCiphers = saved, savedStreamable })
+	decoders = nil
+	streamableCiphers = map[string]bool{"fakestream": true}
+	RegisterDecoder("fakestream", fakeDecoderFunc(streamOffset, "STRM"), ".fake")
+	RegisterDecoder("fakefile", fakeDecoderFunc(0, "FILE"), ".fake")
+}
+
+func TestDecryptStream(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 2*streamHeadSize)
+	tests := []struct {
+		name         string
+		streamOffset int64 // fakestream 校验 magic 的位置
+		input        []byte
+		wantCipher   string
+		wantErr      bool
+	}{
+		{
+			name:       "直接流式解密",
+			input:      append([]byte("STRM"), body...),
+			wantCipher: "fakestream",
+		},
+		{
+			name:       "文件头内探测失败时落盘处理",
+			input:      append([]byte("FILE"), body...),
+			wantCipher: "fakefile",
+		},
+		{
+			name:       "短于文件头的输入落盘处理",
+			input:      []byte("FILE-short"),
+			wantCipher: "fakefile",
+		},
+		{
+			name:         "越过文件头后探测失败不再落盘",
+			streamOffset: streamHeadSize + 16,
+			input:        append([]byte("FILE"), body...),
+			wantErr:      true,
+		},
+		{
+			name:         "越过文件头后探测成功",
+			streamOffset: streamHeadSize + 16,
+			input:        append(append(append([]byte("FILE"), body[:streamHeadSize+12]...), "STRM"...), body...),
+			wantCipher:   "fakestream",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDecoders(t, tt.streamOffset)
+			outDir := t.TempDir()
+
+			res, cleanup, err := NewDecryptService().DecryptStream(context.Background(), bytes.NewReader(tt.input), "a.fake", outDir)
+			defer cleanup()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DecryptStream() = %+v, want error", res)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("DecryptStream() error = %v", err)
+				}
+				if res.Cipher != tt.wantCipher {
+					t.Errorf("cipher = %q, want %q", res.Cipher, tt.wantCipher)
+				}
+				got, err := os.ReadFile(res.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantOffset := tt.streamOffset + 4
+				if tt.wantCipher == "fakefile" {
+					wantOffset = 4
+				}
+				if !bytes.Equal(got, tt.input[wantOffset:]) {
+					t.Errorf("output = %d bytes, want %d", len(got), len(tt.input)-int(wantOffset))
+				}
+			}
+
+			// 落盘的临时文件不应保留，只剩下解密结果
+			entries, _ := os.ReadDir(outDir)
+			want := 0
+			if res != nil {
+				want = 1
+			}
+			if len(entries) != want {
+				t.Errorf("outDir has %d entries, want %d", len(entries), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kgm2flac-backend/internal/utils"
+)
+
+var (
+	ErrUploadNotFound   = errors.New("上传不存在或已过期")
+	ErrOffsetMismatch   = errors.New("Upload-Offset 与已接收的字节数不一致")
+	ErrUploadLocked     = errors.New("该上传正在被另一个请求写入")
+	ErrUploadIncomplete = errors.New("上传尚未完成")
+	ErrUploadTooLong    = errors.New("写入的数据超出 Upload-Length")
+)
+
+// Upload 描述一个可续传的上传，与数据文件一起保存为 <id>.json
+type Upload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"-"` // 以数据文件大小为准
+	Metadata  map[string]string `json:"metadata"`
+	Owner     string            `json:"owner"` // 创建者的 API 密钥名，未启用认证时为空
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// Complete 报告是否已接收全部数据
+func (u *Upload) Complete() bool {
+	return u.Offset >= u.Length
+}
+
+// UploadStore 将可续传上传保存在磁盘上，进程重启后仍可继续。
+// 每次写入都会顺延过期时间，过期的上传（无论是否完成）由后台定期删除
+type UploadStore struct {
+	dir string
+	ttl time.Duration
+
+	mu     sync.Mutex
+	locked map[string]bool // 正在写入或被取走的上传
+}
+
+// NewUploadStore 打开 dir 下的上传存储并启动过期清理
+func NewUploadStore(dir string, ttl time.Duration) (*UploadStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &UploadStore{dir: dir, ttl: ttl, locked: make(map[string]bool)}
+	s.removeExpired()
+	go s.janitor()
+	return s, nil
+}
+
+func (s *UploadStore) dataPath(id string) string { return filepath.Join(s.dir, id+".bin") }
+func (s *UploadStore) infoPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+// Create 新建长度为 length 的上传
+func (s *UploadStore) Create(length int64, meta map[string]string, owner string) (*Upload, error) {
+	now := time.Now()
+	u := &Upload{
+		ID:        utils.RandHex(16),
+		Length:    length,
+		Metadata:  meta,
+		Owner:     owner,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	// 描述文件写入前数据文件不完整，加锁避免被过期清理误删
+	s.lock(u.ID)
+	defer s.unlock(u.ID)
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := s.writeInfo(u); err != nil {
+		_ = os.Remove(s.dataPath(u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+// Get 返回上传的当前状态，不存在或已过期时返回 ErrUploadNotFound
+func (s *UploadStore) Get(id string) (*Upload, error) {
+	if !validUploadID(id) {
+		return nil, ErrUploadNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	var u Upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	info, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	u.Offset = info.Size()
+	return &u, nil
+}
+
+// Append 从 offset 处写入 r 的内容。size 为请求声明的长度，未知时为 -1；
+// 声明或实际的数据超出剩余长度时返回 ErrUploadTooLong，本次写入的数据不保留。
+// 连接中断时已写入的部分会保留，返回的 Upload 反映实际偏移，err 为读取时的错误
+func (s *UploadStore) Append(id string, offset, size int64, r io.Reader) (*Upload, error) {
+	if !s.lock(id) {
+		return nil, ErrUploadLocked
+	}
+	defer s.unlock(id)
+
+	u, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != u.Offset {
+		return u, ErrOffsetMismatch
+	}
+	remaining := u.Length - u.Offset
+	if size > remaining {
+		return u, ErrUploadTooLong
+	}
+
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return u, err
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r, remaining))
+	if copyErr == nil && n == remaining {
+		// 未声明长度时只能在写满之后发现多余的数据，截断回写入前的位置
+		var extra [1]byte
+		if _, err := io.ReadFull(r, extra[:]); err == nil {
+			copyErr = ErrUploadTooLong
+			if err := f.Truncate(u.Offset); err == nil {
+				n = 0
+			}
+		}
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	u.Offset += n
+
+	u.ExpiresAt = time.Now().Add(s.ttl)
+	if err := s.writeInfo(u); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return u, copyErr
+}
+
+// Delete 删除上传及其数据
+func (s *UploadStore) Delete(id string) error {
+	if !s.lock(id) {
+		return ErrUploadLocked
+	}
+	defer s.unlock(id)
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	s.remove(id)
+	return nil
+}
+
+// Take 将已完成上传的数据移动到 dst 并删除该上传，之后不能再续传或重复使用
+func (s *UploadStore) Take(id, dst string) error {
+	if !s.lock(id) {
+		return ErrUploadLocked
+	}
+	defer s.unlock(id)
+
+	u, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if !u.Complete() {
+		return fmt.Errorf("%w（%d/%d bytes）", ErrUploadIncomplete, u.Offset, u.Length)
+	}
+	if err := utils.MoveFile(s.dataPath(id), dst); err != nil {
+		return err
+	}
+	_ = os.Remove(s.infoPath(id))
+	return nil
+}
+
+func (s *UploadStore) writeInfo(u *Upload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, ".tmp_"+utils.RandHex(8))
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.infoPath(u.ID)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *UploadStore) remove(id string) {
+	_ = os.Remove(s.infoPath(id))
+	_ = os.Remove(s.dataPath(id))
+}
+
+func (s *UploadStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[id] {
+		return false
+	}
+	s.locked[id] = true
+	return true
+}
+
+func (s *UploadStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.locked, id)
+	s.mu.Unlock()
+}
+
+// janitor 定期删除过期的上传
+func (s *UploadStore) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.removeExpired()
+	}
+}
+
+// removeExpired 删除过期的上传、缺少描述文件的数据以及遗留的临时文件
+func (s *UploadStore) removeExpired() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		id := strings.TrimSuffix(strings.TrimSuffix(name, ".json"), ".bin")
+		switch {
+		case strings.HasPrefix(name, ".tmp_"):
+			if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > time.Hour {
+				_ = os.Remove(filepath.Join(s.dir, name))
+			}
+		case !validUploadID(id) || !s.lock(id):
+			// 不是上传文件，或正在写入
+		default:
+			if _, err := s.Get(id); errors.Is(err, ErrUploadNotFound) {
+				s.remove(id)
+			}
+			s.unlock(id)
+		}
+	}
+}
+
+// validUploadID 防止路径穿越：ID 必须是 RandHex(16) 生成的 32 位十六进制串
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
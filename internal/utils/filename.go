@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxStemBytes 限制文件名主干的字节数，留出去重后缀与扩展名的空间，
+// 整个文件名不超过常见文件系统 255 字节的上限
+const maxStemBytes = 200
+
+// windowsReserved 是 Windows 上不能作为文件名主干的设备名
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename 将客户端提供的文件名规范为在 Linux、macOS、Windows 上都合法的名字：
+// 去掉目录部分，替换控制字符、非法 UTF-8 与 <>:"/\|?*，去掉首尾空格和结尾的点，
+// 避开 Windows 保留设备名，并在不截断字符的前提下限制长度。结果为空时返回 "file"
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	// 同时按 / 与 \ 去掉目录部分，不依赖服务端的操作系统
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.Cc, r), strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		case unicode.Is(unicode.Cf, r) && r != '\u200d':
+			// 方向控制等不可见格式字符，保留 emoji 使用的零宽连接符
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimSpace(name)
+	name = strings.TrimRight(name, ". ")
+	// 以点开头的文件在类 Unix 系统上会被隐藏
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name[1:]
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if len(ext) > 16 {
+		// 过长的“扩展名”多半只是文件名中的点，不单独保留
+		stem, ext = name, ""
+	}
+	if windowsReserved[strings.ToUpper(strings.SplitN(stem, ".", 2)[0])] {
+		stem = "_" + stem
+	}
+	stem = truncateUTF8(stem, maxStemBytes)
+	stem = strings.TrimRight(stem, ". ")
+	if stem == "" {
+		stem = "file"
+	}
+	return stem + ext
+}
+
+// truncateUTF8 将 s 截断到不超过 n 字节，不切开多字节字符
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// NameSet 为一批文件分配互不相同的名字。比较时不区分大小写，
+// 以兼容 Windows 与 macOS 的默认文件系统；重复的名字依次加上 " (2)"、" (3)"
+type NameSet struct {
+	used map[string]bool
+}
+
+func NewNameSet() *NameSet {
+	return &NameSet{used: make(map[string]bool)}
+}
+
+// Claim 返回 stem 或带序号的 stem，并将其标记为已占用。
+// 同样的输入顺序总是得到同样的结果
+func (s *NameSet) Claim(stem string) string {
+	name := stem
+	for i := 2; s.used[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s (%d)", stem, i)
+	}
+	s.used[strings.ToLower(name)] = true
+	return name
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "普通文件名", in: "歌手 - 歌名.flac", want: "歌手 - 歌名.flac"},
+		{name: "去掉 Unix 目录", in: "../../etc/passwd", want: "passwd"},
+		{name: "去掉 Windows 目录", in: `..\..\evil.flac`, want: "evil.flac"},
+		{name: "只有 ..", in: "..", want: "file"},
+		{name: "以 .. 结尾的路径", in: "a/../..", want: "file"},
+		{name: "隐藏文件", in: ".hidden.flac", want: "_hidden.flac"},
+		{name: "Windows 保留名", in: "CON.flac", want: "_CON.flac"},
+		{name: "保留名不区分大小写", in: "con", want: "_con"},
+		{name: "保留名后有多个扩展名", in: "nul.tar.gz", want: "_nul.tar.gz"},
+		{name: "非保留名", in: "COM10.flac", want: "COM10.flac"},
+		{name: "非法字符", in: `a<b>:c"d|e?f*g.flac`, want: "a_b__c_d_e_f_g.flac"},
+		{name: "结尾的点与空格", in: " song. ", want: "song"},
+		{name: "只有空白", in: "   ", want: "file"},
+		{name: "控制字符", in: "a\x00b\tc.kgm", want: "a_b_c.kgm"},
+		{name: "非法 UTF-8", in: "a\xffb.kgm", want: "a_b.kgm"},
+		{name: "方向控制字符", in: "RTL\u202eflac.exe", want: "RTL_flac.exe"},
+		{name: "保留 emoji 零宽连接符", in: "👨\u200d👩.flac", want: "👨\u200d👩.flac"},
+		{name: "过长的扩展名", in: "a." + strings.Repeat("x", 20), want: "a." + strings.Repeat("x", 20)},
+		{name: "按字符截断", in: strings.Repeat("歌", 100) + ".flac", want: strings.Repeat("歌", 66) + ".flac"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameSetClaim(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{name: "互不相同", in: []string{"a", "b"}, want: []string{"a", "b"}},
+		{name: "重名依次编号", in: []string{"song", "song", "song"}, want: []string{"song", "song (2)", "song (3)"}},
+		{name: "不区分大小写", in: []string{"song", "Song", "SONG"}, want: []string{"song", "Song (2)", "SONG (3)"}},
+		{name: "与已编号的名字冲突", in: []string{"song (2)", "song", "song"}, want: []string{"song (2)", "song", "song (3)"}},
+		{name: "编号后的名字再次重名", in: []string{"a", "a", "A (2)"}, want: []string{"a", "a (2)", "A (2) (2)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewNameSet()
+			for i, in := range tt.in {
+				if got := s.Claim(in); got != tt.want[i] {
+					t.Errorf("Claim(%q) #%d = %q, want %q", in, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ProcessAlive 判断 pid 对应的进程是否仍在运行
+func ProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM 表示进程存在但属于其他用户
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package utils
+
+import "os"
+
+// ProcessAlive 判断 pid 对应的进程是否仍在运行
+func ProcessAlive(pid int) bool {
+	// Windows 上 FindProcess 会打开进程句柄，进程不存在时返回错误
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
@@ -0,0 +1,25 @@
+package utils
+
+import "context"
+
+// Semaphore 限制并发数
+type Semaphore chan struct{}
+
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		n = 1
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire 获取一个名额，ctx 取消时放弃等待
+func (s Semaphore) Acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s Semaphore) Release() { <-s }
@@ -0,0 +1,346 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kgm2flac-backend/internal/config"
+	"kgm2flac-backend/internal/logging"
+	"kgm2flac-backend/internal/service"
+	"kgm2flac-backend/internal/utils"
+	"kgm2flac-backend/pkg/types"
+
+	"go.uber.org/zap"
+)
+
+// Watcher 轮询监视目录，转换写入完成的新文件。
+// 文件的大小与修改时间在相邻两次轮询间不变时视为写入完成
+type Watcher struct {
+	cfg        config.WatchConfig
+	conv       *service.Converter
+	opts       service.Options
+	workers    int
+	timeout    time.Duration
+	quarantine string
+	skipDirs   []string // 位于监视目录内的输出、隔离目录，扫描时跳过
+
+	workDir  string
+	pending  map[string]fileStat // 上次轮询看到的文件
+	outBases map[string]string   // 源文件对应的输出路径（不含扩展名），只由 scan 访问，条目在运行期间保留
+	outNames *utils.NameSet      // 已分配的输出路径
+
+	mu      sync.Mutex
+	handled map[string]fileStat // keep 模式下已处理、仍留在原处的文件
+}
+
+type fileStat struct {
+	size int64
+	mod  time.Time
+}
+
+// readyFile 是一个写入完成、等待转换的文件
+type readyFile struct {
+	path    string
+	rel     string // 相对所在监视目录的路径
+	outBase string // 输出路径（不含扩展名），不与其他源文件重复
+	stat    fileStat
+}
+
+func New(cfg *config.Config, conv *service.Converter) (*Watcher, error) {
+	wc := cfg.Watch
+	if len(wc.Dirs) == 0 {
+		return nil, errors.New("未配置监视目录 watch.dirs")
+	}
+	if wc.OutputDir == "" {
+		return nil, errors.New("未配置输出目录 watch.output_dir")
+	}
+	if wc.Interval <= 0 {
+		return nil, fmt.Errorf("watch.interval 无效: %s", wc.Interval)
+	}
+	switch wc.OnSuccess {
+	case config.WatchKeep, config.WatchDelete:
+	case config.WatchMove:
+		if wc.DoneDir == "" {
+			return nil, errors.New("on_success 为 move 时需要配置 watch.done_dir")
+		}
+	default:
+		return nil, fmt.Errorf("watch.on_success 取值无效: %q，可选 keep/move/delete", wc.OnSuccess)
+	}
+
+	format, ok := service.ValidChoice(cfg.DefaultFormat)
+	if !ok {
+		return nil, fmt.Errorf("配置的默认输出格式 %q 无效", cfg.DefaultFormat)
+	}
+
+	quarantine := wc.QuarantineDir
+	if quarantine == "" {
+		quarantine = filepath.Join(wc.OutputDir, "_failed")
+	}
+
+	w := &Watcher{
+		cfg:        wc,
+		conv:       conv,
+		opts:       service.Options{Format: format, StripMetadata: cfg.StripMetadata},
+		workers:    cfg.Workers,
+		timeout:    cfg.FileTimeout,
+		quarantine: quarantine,
+		pending:    make(map[string]fileStat),
+		outBases:   make(map[string]string),
+		outNames:   utils.NewNameSet(),
+		handled:    make(map[string]fileStat),
+	}
+	for _, dir := range []string{wc.OutputDir, quarantine, wc.DoneDir} {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			w.skipDirs = append(w.skipDirs, abs)
+		}
+	}
+	return w, nil
+}
+
+// Run 持续轮询直到 ctx 取消
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := os.MkdirAll(w.cfg.OutputDir, 0o755); err != nil {
+		return err
+	}
+	// 中间文件放在输出目录下，完成后在同一文件系统内重命名到目标位置
+	workDir, err := os.MkdirTemp(w.cfg.OutputDir, ".kgm2flac_watch_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	w.workDir = workDir
+
+	zap.L().Info("watch start",
+		zap.Strings("dirs", w.cfg.Dirs),
+		zap.String("out", w.cfg.OutputDir),
+		zap.Duration("interval", w.cfg.Interval),
+		zap.String("on_success", w.cfg.OnSuccess),
+		zap.String("format", w.opts.Format))
+
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		w.poll(ctx)
+		select {
+		case <-ctx.Done():
+			zap.L().Info("watch stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll 扫描一次监视目录，并发转换所有写入完成的文件
+func (w *Watcher) poll(ctx context.Context) {
+	ready := w.scan()
+	if len(ready) == 0 {
+		return
+	}
+
+	sem := utils.NewSemaphore(w.workers)
+	var wg sync.WaitGroup
+	for _, f := range ready {
+		if err := sem.Acquire(ctx); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(f readyFile) {
+			defer wg.Done()
+			defer sem.Release()
+			w.process(ctx, f)
+		}(f)
+	}
+	wg.Wait()
+}
+
+// scan 返回与上次轮询相比没有变化的文件
+func (w *Watcher) scan() []readyFile {
+	seen := make(map[string]fileStat)
+	var ready []readyFile
+
+	for _, dir := range w.cfg.Dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				zap.L().Warn("watch scan failed", zap.String("path", path), zap.Error(err))
+				if d != nil && d.IsDir() && path != dir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				if path != dir && (!w.cfg.Recursive || w.isSkipped(path)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || !service.IsSupportedExt(filepath.Ext(path)) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+
+			rel, _ := filepath.Rel(dir, path)
+			// 在判断是否已处理之前分配输出路径，按扫描顺序分配的结果与处理的先后无关
+			outBase := w.outBase(path, rel)
+			st := fileStat{size: info.Size(), mod: info.ModTime()}
+			if w.isHandled(path, st) {
+				return nil
+			}
+			seen[path] = st
+			if prev, ok := w.pending[path]; ok && prev == st && st.size > 0 {
+				ready = append(ready, readyFile{path: path, rel: rel, outBase: outBase, stat: st})
+			}
+			return nil
+		})
+		if err != nil {
+			zap.L().Warn("watch scan failed", zap.String("dir", dir), zap.Error(err))
+		}
+	}
+
+	w.pending = seen
+	return ready
+}
+
+// outBase 返回源文件的输出路径。不同源文件映射到同一输出时（如同一目录下的 a.kgm 与 a.ncm，
+// 或两个监视目录中相对路径相同的文件），后扫描到的依次加上 " (2)" 等序号；
+// 同一源文件在本次运行中始终得到同一输出
+func (w *Watcher) outBase(path, rel string) string {
+	if base, ok := w.outBases[path]; ok {
+		return base
+	}
+	base := filepath.Join(w.cfg.OutputDir, w.outNames.Claim(utils.ReplaceExt(rel, "")))
+	w.outBases[path] = base
+	return base
+}
+
+func (w *Watcher) isSkipped(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, d := range w.skipDirs {
+		if abs == d {
+			return true
+		}
+	}
+	// 跳过 Run 创建的临时目录等隐藏目录
+	return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+func (w *Watcher) isHandled(path string, st fileStat) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prev, ok := w.handled[path]
+	return ok && prev == st
+}
+
+func (w *Watcher) markHandled(f readyFile) {
+	w.mu.Lock()
+	w.handled[f.path] = f.stat
+	w.mu.Unlock()
+}
+
+// process 转换单个文件，成功后按 on_success 处理源文件，失败时移入隔离目录
+func (w *Watcher) process(ctx context.Context, f readyFile) {
+	outBase := f.outBase
+	if w.cfg.OnSuccess == config.WatchKeep {
+		if out := service.ExistingOutput(outBase, w.opts.Format); out != "" {
+			w.markHandled(f)
+			return
+		}
+	}
+
+	logger := zap.L().With(zap.String("file", f.path))
+	fctx := logging.WithContext(ctx, logger)
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		fctx, cancel = context.WithTimeout(fctx, w.timeout)
+		defer cancel()
+	}
+
+	res, tagErr := w.conv.ConvertFile(fctx, f.path, outBase, w.workDir, w.opts)
+	if ctx.Err() != nil {
+		// 正在退出，源文件留在原处，下次启动时重新处理
+		return
+	}
+	if tagErr != nil {
+		logger.Warn("write metadata failed", zap.Error(tagErr))
+	}
+	if res.Err != nil {
+		logger.Warn("watch failed", zap.String("code", types.ErrorCode(res.Err)), zap.Error(res.Err))
+		w.quarantineFile(logger, f, res)
+		return
+	}
+	logger.Info("watch done",
+		zap.String("out", res.OutPath),
+		zap.String("cipher", res.Cipher),
+		zap.String("action", res.Action),
+		zap.Duration("dur", res.Duration))
+
+	switch w.cfg.OnSuccess {
+	case config.WatchKeep:
+		w.markHandled(f)
+	case config.WatchMove:
+		dst := filepath.Join(w.cfg.DoneDir, f.rel)
+		if err := moveInto(f.path, dst); err != nil {
+			logger.Error("move source failed", zap.Error(err))
+			w.markHandled(f)
+		}
+	case config.WatchDelete:
+		if err := os.Remove(f.path); err != nil {
+			logger.Error("delete source failed", zap.Error(err))
+			w.markHandled(f)
+		}
+	}
+}
+
+// errorSidecar 是隔离文件旁的错误说明
+type errorSidecar struct {
+	Source   string    `json:"source"`
+	FailedAt time.Time `json:"failed_at"`
+	types.FileStatus
+}
+
+// quarantineFile 将失败的源文件移入隔离目录，并写入 <文件名>.error.json
+func (w *Watcher) quarantineFile(logger *zap.Logger, f readyFile, res types.ConvertResult) {
+	dst := filepath.Join(w.quarantine, f.rel)
+	if err := moveInto(f.path, dst); err != nil {
+		// 无法移动时留在原处，本次运行内不再重试
+		logger.Error("quarantine failed", zap.Error(err))
+		w.markHandled(f)
+		return
+	}
+
+	data, err := json.MarshalIndent(errorSidecar{
+		Source:     f.path,
+		FailedAt:   time.Now(),
+		FileStatus: types.NewFileStatus(res),
+	}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(dst+".error.json", data, 0o644)
+	}
+	if err != nil {
+		logger.Error("write error sidecar failed", zap.String("sidecar", dst+".error.json"), zap.Error(err))
+	}
+}
+
+// moveInto 将文件移动到 dst，必要时创建目录
+func moveInto(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return utils.MoveFile(src, dst)
+}
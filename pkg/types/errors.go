@@ -0,0 +1,73 @@
+package types
+
+import "errors"
+
+// 稳定的错误码，供 API 客户端判断失败原因，不随提示文案变化
+const (
+	CodeBadRequest        = "bad_request"        // 请求格式错误
+	CodeInvalidOption     = "invalid_option"     // format 等选项取值无效
+	CodeNoFiles           = "no_files"           // 未上传文件
+	CodeTooManyFiles      = "too_many_files"     // 文件数超过 max_files
+	CodeRequestTooLarge   = "request_too_large"  // 请求体超过总大小限制
+	CodeFileTooLarge      = "file_too_large"     // 单个文件超过 max_file_size
+	CodeUploadFailed      = "upload_failed"      // 上传内容保存失败
+	CodeUploadIncomplete  = "upload_incomplete"  // 可续传上传尚未接收完全部数据
+	CodeOffsetMismatch    = "offset_mismatch"    // 续传偏移与已接收的字节数不一致，或上传正被写入
+	CodeUnsupportedCipher = "unsupported_cipher" // 无法识别的加密格式
+	CodeDecryptFailed     = "decrypt_failed"     // 解密过程出错
+	CodeSniffFailed       = "sniff_failed"       // 无法识别解密后的音频格式
+	CodeTranscodeFailed   = "transcode_failed"   // ffmpeg 转码失败
+	CodeOutputFailed      = "output_failed"      // 输出文件写入失败
+	CodeTimeout           = "timeout"            // 超过 file_timeout
+	CodeCanceled          = "canceled"           // 请求被取消
+	CodeAllFailed         = "all_failed"         // 所有文件处理失败
+	CodeNotFound          = "not_found"          // 任务或上传不存在或已过期
+	CodeJobNotReady       = "job_not_ready"      // 任务尚未完成
+	CodeShuttingDown      = "shutting_down"      // 服务正在关闭，不再接收新上传
+	CodeUnauthorized      = "unauthorized"       // 缺少或无效的 API 密钥
+	CodeQuotaExceeded     = "quota_exceeded"     // 超出 API 密钥的每日配额或并发上限
+	CodeRateLimited       = "rate_limited"       // 客户端请求、文件数或上传字节数超出频率限制
+	CodeInternal          = "internal"           // 服务端内部错误
+)
+
+// Error 为错误附加错误码，Error() 保持原有提示文案
+type Error struct {
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// NewError 为 err 附加错误码
+func NewError(code string, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// ErrorCode 返回 err 链上的错误码，未标记的错误视为 internal，nil 返回空字符串
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+// ErrorDetail 返回 err 链上附带的诊断输出（如 ffmpeg 的错误日志），没有时返回空字符串
+func ErrorDetail(err error) string {
+	var d interface{ Detail() string }
+	if errors.As(err, &d) {
+		return d.Detail()
+	}
+	return ""
+}
+
+// APIError 是 JSON 模式下的错误响应
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -1,11 +1,148 @@
 package types
 
-import "time"
+import (
+	"path/filepath"
+	"time"
+)
+
+// 单个文件的处理状态
+const (
+	StateQueued      = "queued"
+	StateDecrypting  = "decrypting"
+	StateTranscoding = "transcoding"
+	StateDone        = "done"
+	StateFailed      = "failed"
+)
 
 type ConvertResult struct {
-	OrigName string        `json:"orig_name"`
-	OutPath  string        `json:"out_path"`
-	Err      error         `json:"error"`
-	Size     int64         `json:"size"`
-	Duration time.Duration `json:"duration"`
+	OrigName     string        `json:"orig_name"`
+	Cipher       string        `json:"cipher"`
+	Format       string        `json:"format"`        // 请求的输出格式或模式
+	SourceFormat string        `json:"source_format"` // 解密后嗅探到的源格式
+	Action       string        `json:"action"`        // passthrough 或 transcode
+	State        string        `json:"state"`
+	OutPath      string        `json:"out_path"`
+	Err          error         `json:"-"` // 通过 NewFileStatus 序列化为错误码与文案
+	Size         int64         `json:"size"`
+	Duration     time.Duration `json:"duration"`
+	Cached       bool          `json:"cached"` // 结果来自缓存
+}
+
+// 任务状态
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// FileStatus 是 ConvertResult 面向 API 的序列化形式
+type FileStatus struct {
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	Cipher       string `json:"cipher,omitempty"`
+	Format       string `json:"format,omitempty"`
+	SourceFormat string `json:"source_format,omitempty"`
+	Action       string `json:"action,omitempty"`
+	Output       string `json:"output,omitempty"` // 输出文件名
+	Cached       bool   `json:"cached,omitempty"` // 结果来自缓存
+	Size         int64  `json:"size"`
+	Code         string `json:"code,omitempty"` // 失败时的错误码
+	Error        string `json:"error,omitempty"`
+	Detail       string `json:"detail,omitempty"` // 失败时的诊断输出，如 ffmpeg 最后的错误日志
+	DurationMs   int64  `json:"duration_ms"`
+}
+
+// JobStatus 描述异步任务的整体进度
+type JobStatus struct {
+	ID          string       `json:"id"`
+	State       string       `json:"state"`
+	Total       int          `json:"total"`
+	Success     int          `json:"success"`
+	Failed      int          `json:"failed"`
+	CreatedAt   time.Time    `json:"created_at"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+	DownloadURL string       `json:"download_url,omitempty"`
+	Files       []FileStatus `json:"files"`
+}
+
+// NewFileStatus 从 ConvertResult 构建 FileStatus
+func NewFileStatus(r ConvertResult) FileStatus {
+	fs := FileStatus{
+		Name:         r.OrigName,
+		State:        r.State,
+		Cipher:       r.Cipher,
+		Format:       r.Format,
+		SourceFormat: r.SourceFormat,
+		Action:       r.Action,
+		Size:         r.Size,
+		Cached:       r.Cached,
+		DurationMs:   r.Duration.Milliseconds(),
+	}
+	if r.OutPath != "" {
+		fs.Output = filepath.Base(r.OutPath)
+	}
+	if r.Err != nil {
+		fs.Code = ErrorCode(r.Err)
+		fs.Error = r.Err.Error()
+		fs.Detail = ErrorDetail(r.Err)
+	}
+	return fs
+}
+
+// 任务进度事件，即 /api/jobs/{id}/events 中 SSE 的 event 字段
+const (
+	EventReceived     = "received"      // 上传文件已保存
+	EventDecryptStart = "decrypt_start" // 开始解密
+	EventDecryptDone  = "decrypt_done"  // 解密完成，附带加密格式
+	EventFormat       = "format"        // 已识别源格式并确定输出格式与处理方式
+	EventProgress     = "progress"      // ffmpeg 转码进度百分比
+	EventResult       = "result"        // 单个文件处理结束，附带最终状态
+	EventDone         = "done"          // 任务结束，数据为 JobStatus
+)
+
+// FileEvent 是单个文件的进度事件，Index 为文件在任务中的序号（从 0 开始）
+type FileEvent struct {
+	Index        int         `json:"index"`
+	Name         string      `json:"name"`
+	Size         int64       `json:"size,omitempty"`
+	Cipher       string      `json:"cipher,omitempty"`
+	SourceFormat string      `json:"source_format,omitempty"`
+	Action       string      `json:"action,omitempty"`
+	Format       string      `json:"format,omitempty"`
+	Percent      float64     `json:"percent,omitempty"`
+	Result       *FileStatus `json:"result,omitempty"` // 仅 result 事件
+}
+
+// Report 是一批文件的处理结果清单
+type Report struct {
+	Total   int          `json:"total"`
+	Success int          `json:"success"`
+	Failed  int          `json:"failed"`
+	Files   []FileStatus `json:"files"`
+}
+
+// NewReport 从 ConvertResult 列表构建 Report
+func NewReport(results []ConvertResult) Report {
+	rep := Report{
+		Total: len(results),
+		Files: make([]FileStatus, 0, len(results)),
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			rep.Failed++
+		} else {
+			rep.Success++
+		}
+		rep.Files = append(rep.Files, NewFileStatus(r))
+	}
+	return rep
+}
+
+// BuildInfo 是编译时通过 -ldflags 注入的版本信息
+type BuildInfo struct {
+	Version    string `json:"version"`
+	BuildDate  string `json:"build_date"`
+	CommitHash string `json:"commit_hash"`
+	AppEnv     string `json:"app_env"`
+	GoVersion  string `json:"go_version"`
 }